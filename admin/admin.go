@@ -0,0 +1,249 @@
+// Package admin serves an HTTP API for inspecting and managing the allocators of the driver.
+//
+// Every endpoint is prefixed with the address space it acts on, "local" or "global":
+//
+//	GET    /{space}/state                       the full allocator state
+//	GET    /{space}/pools/free                  free pools
+//	GET    /{space}/pools                       allocated pools with their addresses
+//	DELETE /{space}/pools?pool=CIDR             force-release an allocated pool
+//	DELETE /{space}/addresses?pool=CIDR&ip=IP   force-release an allocated address
+//	GET    /{space}/base                        base pools
+//	POST   /{space}/base?pool=CIDR              add a base pool
+//	DELETE /{space}/base?pool=CIDR              remove a base pool
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nategraf/mini-ipam-driver/allocator"
+)
+
+// DefaultSocket is where the admin API listens by default.
+const DefaultSocket = "/run/mini-ipam/admin.sock"
+
+// Server handles admin API requests for a set of allocators.
+type Server struct {
+	// Allocators are keyed by the name of their address space.
+	Allocators map[string]allocator.Allocator
+}
+
+// NewServer creates a Server for the local and global allocators, either of which may be nil.
+func NewServer(local, global allocator.Allocator) *Server {
+	s := &Server{Allocators: make(map[string]allocator.Allocator)}
+	for _, a := range []allocator.Allocator{local, global} {
+		if a != nil {
+			s.Allocators[allocator.AddrSpace(a)] = a
+		}
+	}
+	return s
+}
+
+// PoolStatus describes an allocated pool.
+type PoolStatus struct {
+	Pool      string   `json:"pool"`
+	Gateway   string   `json:"gateway,omitempty"`
+	Addresses []string `json:"addresses"`
+}
+
+// apiError is an error with the HTTP status it should be reported with.
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e *apiError) Error() string {
+	return e.msg
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &apiError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := checkLocalRequest(r); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	parts := strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 2)
+	a, found := s.Allocators[parts[0]]
+	if !found {
+		writeError(w, &apiError{http.StatusNotFound, fmt.Sprintf("Unknown address space: %s", parts[0])})
+		return
+	}
+	resource := ""
+	if len(parts) > 1 {
+		resource = parts[1]
+	}
+
+	var res interface{}
+	var err error
+	switch r.Method + " " + resource {
+	case "GET state":
+		res, err = a.Snapshot()
+	case "GET pools/free":
+		res, err = freePools(a)
+	case "GET pools":
+		res, err = allocatedPools(a)
+	case "DELETE pools":
+		err = withPool(r, a.ReleasePool)
+	case "DELETE addresses":
+		err = releaseAddress(r, a)
+	case "GET base":
+		res, err = basePools(a)
+	case "POST base":
+		err = withPool(r, a.AddPool)
+	case "DELETE base":
+		err = withPool(r, a.RemovePool)
+	default:
+		err = &apiError{http.StatusNotFound, fmt.Sprintf("No such endpoint: %s %s", r.Method, r.URL.Path)}
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if res == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// checkLocalRequest refuses requests which may have been made by a web page, since the API has no authentication.
+// Browsers send an Origin with every cross-site request which can change state, and requiring the Host to name the
+// loopback interface stops pages on other sites from reaching the API through DNS rebinding.
+func checkLocalRequest(r *http.Request) error {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		return &apiError{http.StatusForbidden, fmt.Sprintf("Requests from web pages are not allowed, got origin %s", origin)}
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(strings.Trim(host, "[]")); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return &apiError{http.StatusForbidden, fmt.Sprintf("Host must be localhost or a loopback address, not %q", r.Host)}
+	}
+	return nil
+}
+
+func freePools(a allocator.Allocator) ([]string, error) {
+	st, err := a.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return nonNil(st.FreePools()), nil
+}
+
+func basePools(a allocator.Allocator) ([]string, error) {
+	st, err := a.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return nonNil(st.BasePools()), nil
+}
+
+func allocatedPools(a allocator.Allocator) ([]*PoolStatus, error) {
+	st, err := a.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	res := []*PoolStatus{}
+	for _, pool := range st.Allocated {
+		res = append(res, &PoolStatus{Pool: pool, Gateway: st.Gateways[pool], Addresses: nonNil(st.Addresses[pool])})
+	}
+	return res, nil
+}
+
+// withPool calls fn with the pool given in the query string.
+func withPool(r *http.Request, fn func(*net.IPNet) error) error {
+	pool, err := queryPool(r)
+	if err != nil {
+		return err
+	}
+	return fn(pool)
+}
+
+func releaseAddress(r *http.Request, a allocator.Allocator) error {
+	pool, err := queryPool(r)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(r.URL.Query().Get("ip"))
+	if ip == nil {
+		return badRequest("Invalid or missing ip: %q", r.URL.Query().Get("ip"))
+	}
+	return a.ReleaseAddress(pool, ip)
+}
+
+func queryPool(r *http.Request) (*net.IPNet, error) {
+	str := r.URL.Query().Get("pool")
+	_, pool, err := net.ParseCIDR(str)
+	if err != nil {
+		return nil, badRequest("Invalid or missing pool: %q", str)
+	}
+	return pool, nil
+}
+
+// writeError reports an error as JSON, with a status matching the kind of error the allocator returned.
+func writeError(w http.ResponseWriter, err error) {
+	var status int
+	switch e := err.(type) {
+	case *apiError:
+		status = e.status
+	case allocator.ErrNotFound:
+		status = http.StatusNotFound
+	case allocator.ErrInvalidArgument:
+		status = http.StatusBadRequest
+	case allocator.ErrConflict, allocator.ErrExhausted:
+		status = http.StatusConflict
+	case allocator.ErrContention:
+		status = http.StatusServiceUnavailable
+	default:
+		status = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// nonNil makes empty lists encode as [] rather than null.
+func nonNil(strs []string) []string {
+	if strs == nil {
+		return []string{}
+	}
+	return strs
+}
+
+// Listen opens the admin listener at addr, which is either the path of a Unix socket or a host:port on the loopback interface.
+// The API is unauthenticated, so it is never exposed beyond the host.
+func Listen(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix://"); strings.HasPrefix(path, "/") {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		// Remove a socket left behind by a previous run
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("Admin API must listen on a Unix socket or a loopback address, not %s", addr)
+	}
+	return net.Listen("tcp", addr)
+}
@@ -0,0 +1,60 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nategraf/mini-ipam-driver/allocator"
+)
+
+func TestServerRefusesWebRequests(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		host   string
+		origin string
+		want   int
+	}{
+		{"localhost", http.MethodGet, "localhost", "", http.StatusOK},
+		{"loopback address", http.MethodGet, "127.0.0.1:9210", "", http.StatusOK},
+		{"IPv6 loopback address", http.MethodGet, "[::1]:9210", "", http.StatusOK},
+		{"add base pool", http.MethodPost, "127.0.0.1:9210", "", http.StatusNoContent},
+		{"cross-site request", http.MethodPost, "127.0.0.1:9210", "http://example.com", http.StatusForbidden},
+		{"same-origin page", http.MethodGet, "localhost:9210", "http://localhost:9210", http.StatusForbidden},
+		{"rebound name", http.MethodGet, "attacker.example.com:9210", "", http.StatusForbidden},
+		{"rebound name adding a pool", http.MethodPost, "attacker.example.com:9210", "", http.StatusForbidden},
+		{"other address", http.MethodGet, "192.0.2.1:9210", "", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := allocator.NewLocalAllocator(allocator.NewMemoryStore())
+			s := NewServer(a, nil)
+
+			path := "/local/base"
+			if test.method == http.MethodPost {
+				path += "?pool=10.1.0.0/16"
+			}
+			r := httptest.NewRequest(test.method, path, nil)
+			r.Host = test.host
+			if test.origin != "" {
+				r.Header.Set("Origin", test.origin)
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+
+			if w.Code != test.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, test.want, w.Body.String())
+			}
+			st, err := a.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			added := len(st.BasePools()) > 0
+			if wantAdded := test.want == http.StatusNoContent; added != wantAdded {
+				t.Errorf("base pool added = %t, want %t", added, wantAdded)
+			}
+		})
+	}
+}
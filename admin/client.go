@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nategraf/mini-ipam-driver/allocator"
+	"github.com/nategraf/mini-ipam-driver/unixhttp"
+)
+
+// Client makes requests to the admin API of a running driver.
+type Client struct {
+	// BaseURL is prefixed to every request path.
+	BaseURL string
+	// HTTP is used to make requests, which for a Unix socket must dial the socket.
+	HTTP *http.Client
+}
+
+// NewClient creates a Client for the admin API listening at addr, in the form accepted by Listen.
+func NewClient(addr string) *Client {
+	if path := strings.TrimPrefix(addr, "unix://"); strings.HasPrefix(path, "/") {
+		// The host is ignored by the dialer, but the server only accepts loopback names
+		return &Client{BaseURL: "http://localhost", HTTP: unixhttp.NewClient(path, 10*time.Second)}
+	}
+	return &Client{BaseURL: "http://" + addr, HTTP: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// State gives the state of the allocator for an address space.
+func (c *Client) State(space string) (*allocator.State, error) {
+	st := &allocator.State{}
+	if err := c.do(http.MethodGet, "/"+space+"/state", nil, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// ReleasePool force-releases an allocated pool.
+func (c *Client) ReleasePool(space string, pool *net.IPNet) error {
+	return c.do(http.MethodDelete, "/"+space+"/pools", url.Values{"pool": {pool.String()}}, nil)
+}
+
+// do makes a request and decodes the JSON response into v, if it is non-nil.
+func (c *Client) do(method, path string, query url.Values, v interface{}) error {
+	u := c.BaseURL + path
+	if query != nil {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var body struct{ Error string }
+		if json.NewDecoder(resp.Body).Decode(&body) == nil && body.Error != "" {
+			return fmt.Errorf("%s", body.Error)
+		}
+		return fmt.Errorf("Admin API returned %s for %s %s", resp.Status, method, path)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
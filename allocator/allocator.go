@@ -1,15 +1,11 @@
 package allocator
 
 import (
-	"bytes"
-	"encoding/gob"
-	"fmt"
 	"github.com/nategraf/mini-ipam-driver/bytop"
-	"io/ioutil"
 	"net"
-	"os"
-	"path"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Allocator is simplified interface for managing IP addresses.
@@ -17,15 +13,23 @@ type Allocator interface {
 	addrSpace() string
 
 	AddPool(*net.IPNet) error
-	RequestPool(int, *net.IPNet) (*net.IPNet, error)
+	RequestPool(string, int, bool, *net.IPNet) (*net.IPNet, error)
+	RequestStickyPool(string, string, int, bool) (*net.IPNet, error)
 	ReleasePool(*net.IPNet) error
-	RequestAddress(*net.IPNet, net.IP) (net.IP, error)
-	ReleaseAddress(net.IP) error
+	RequestAddress(*net.IPNet, *net.IPNet, net.IP) (net.IP, error)
+	RequestStickyAddress(*net.IPNet, *net.IPNet, string) (net.IP, error)
+	RequestGateway(*net.IPNet, net.IP) (net.IP, error)
+	ReleaseAddress(*net.IPNet, net.IP) error
+
+	RemovePool(*net.IPNet) error
+	Snapshot() (*State, error)
+	Usage() (*Usage, error)
 }
 
 const NilAS = "null"
 
-var localBackup = path.Join(os.TempDir(), "mini-ipam.gob")
+// DefaultStateDir is where LocalAllocator state is saved when no other directory is given.
+const DefaultStateDir = "/var/lib/mini-ipam"
 
 func AddrSpace(a Allocator) string {
 	if a == nil {
@@ -37,188 +41,424 @@ func AddrSpace(a Allocator) string {
 // LocalAllocator is an allocator which stores data in process memory.
 // It does not use an external data store and therefore cannot be used across a cluster.
 type LocalAllocator struct {
-	pools     [][]*net.IPNet
-	allocated map[string]bool
+	classes   map[string]*poolClass   // Free pools and base pools of each pool class, by name
+	allocated map[string]*addrBitmap  // Allocated pools mapped to the addresses allocated in each
+	leases    map[string][]*net.IPNet // Pools last allocated for each sticky key, at most one per address family
 	lock      sync.RWMutex
 	update    *sync.Cond
 	updated   bool
+	store     Store
+	saveLock  sync.Mutex
+	seq       uint64 // Sequence number of the last journal entry
+	replaying bool
+	avoid     func() ([]*net.IPNet, error)
+	excluded  []*net.IPNet  // Subnets which are never handed out
+	reserved  []OffsetRange // Address offsets reserved in new pools
+	gateway   GatewayPosition
+	policy    SelectionPolicy
+
+	// Persistence failures, counted for metrics and accessed atomically
+	saveFailures    uint64
+	journalFailures uint64
 }
 
-// NewLocalAllocator creates and initializes a new LocalAllocator
-func NewLocalAllocator() *LocalAllocator {
-	a := &LocalAllocator{}
+// NewLocalAllocator creates and initializes a new LocalAllocator which saves its state to store.
+func NewLocalAllocator(store Store) *LocalAllocator {
+	a := &LocalAllocator{store: store}
 	a.init()
 	return a
 }
 
-// NewLocalAllocator creates and initializes a new LocalAllocator
-func LoadLocalAllocator() (*LocalAllocator, error) {
-	a := &LocalAllocator{}
-	err := a.load()
-	return a, err
+// LoadLocalAllocator creates a LocalAllocator from the state saved in store.
+// An error satisfying os.IsNotExist is returned if there is no saved state.
+func LoadLocalAllocator(store Store) (*LocalAllocator, error) {
+	a := &LocalAllocator{store: store}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Close saves the allocator state and closes its store.
+func (a *LocalAllocator) Close() error {
+	err := a.save()
+	if cerr := a.store.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 func (a *LocalAllocator) init() {
-	a.pools = make([][]*net.IPNet, 32)
-	a.allocated = make(map[string]bool)
+	a.reset()
+
+	go a.autosave()
+}
+
+// reset sets the allocator to an empty state.
+func (a *LocalAllocator) reset() {
+	a.clearNoLock()
 	a.lock = sync.RWMutex{}
 	a.update = sync.NewCond(a.lock.RLocker())
 	a.updated = false
+}
 
-	go a.autosave()
+// clearNoLock empties the pools, allocations, and leases of the allocator.
+func (a *LocalAllocator) clearNoLock() {
+	a.classes = map[string]*poolClass{DefaultClass: newPoolClass()}
+	a.excluded = nil
+	a.allocated = make(map[string]*addrBitmap)
+	a.leases = make(map[string][]*net.IPNet)
 }
 
 func (a *LocalAllocator) addrSpace() string {
 	return "local"
 }
 
-// AddPool adds a new subnet to be used in allocations.
+// AddPool adds a new subnet to the default pool class to be used in allocations.
 func (a *LocalAllocator) AddPool(pool *net.IPNet) error {
-	if len(pool.Mask) != 4 {
-		// This is not a proper IPv4 subnet. Abort!
-		return fmt.Errorf("Only 32-bit IPv4 subnets can be added")
+	if normalizePool(pool) == nil {
+		// This is not a proper IPv4 or IPv6 subnet. Abort!
+		return invalidf("Only IPv4 and IPv6 subnets can be added")
+	}
+	if masklen, bits := pool.Mask.Size(); masklen >= bits {
+		return invalidf("Pool must contain more than one address: %s", pool.String())
 	}
 
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
-	return a.addPoolNoLock(pool)
+	if err := a.checkAddOverlapNoLock(normalizePool(pool)); err != nil {
+		return err
+	}
+	prev := a.snapshotNoLock()
+
+	// Excluded subnets are carved out of the pool before it is added
+	c := a.classes[DefaultClass]
+	_, allowed := clipPool(normalizePool(pool), a.excluded)
+	for _, p := range allowed {
+		if err := a.addPoolNoLock(c, p); err != nil {
+			return err
+		}
+	}
+	c.base = append(c.base, normalizePool(pool))
+	if err := a.recordNoLock(&JournalEntry{Op: opAddPool, Pool: normalizePool(pool).String()}); err != nil {
+		a.rollbackNoLock(prev)
+		return err
+	}
+	return nil
 }
 
-func (a *LocalAllocator) addPoolNoLock(pool *net.IPNet) error {
+// addPoolNoLock adds a free pool to the free lists of a class, merging it with its buddy if that is free.
+func (a *LocalAllocator) addPoolNoLock(c *poolClass, pool *net.IPNet) error {
 	// Operate on a normalized copy of the origonal
 	pool = normalizePool(pool)
 
-	masklen, _ := pool.Mask.Size()
+	masklen, bits := pool.Mask.Size()
+	pools := c.freeLists(bits)
 
-	s := a.pools[masklen]
+	s := pools[masklen]
 	for i, pooli := range s {
 		if bytop.Equal(pool.IP, pooli.IP) {
-			return fmt.Errorf("Pool has already been added: %s", pool.String())
+			return conflictf("Pool has already been added: %s", pool.String())
 		}
 		if masklen != 0 && bytop.Equal(pool.IP, adjacentPool(pooli).IP) {
-			a.pools[masklen] = append(s[:i], s[i+1:]...) // Remove the found pool from the list
-			return a.addPoolNoLock(expandPool(pool))     // "Merge" the two and add the result to the allocator
+			pools[masklen] = append(s[:i], s[i+1:]...)  // Remove the found pool from the list
+			return a.addPoolNoLock(c, expandPool(pool)) // "Merge" the two and add the result to the allocator
 		}
 	}
-	a.pools[masklen] = append(s, pool)
+	pools[masklen] = append(s, pool)
 	a.signalUpdate()
 	return nil
 }
 
-// RequestPool allocates a pool of the requested size.
+// RequestPool allocates a pool of the requested size from the IPv4 or IPv6 pools of the named class.
+// If pool is non-nil, that exact subnet is allocated from whichever class holds it, and class, masklen, and v6 are ignored.
 // nil is returned if the request cannnot be fulfiled.
-func (a *LocalAllocator) RequestPool(masklen int, pool *net.IPNet) (*net.IPNet, error) {
+func (a *LocalAllocator) RequestPool(class string, masklen int, v6 bool, pool *net.IPNet) (*net.IPNet, error) {
+	return a.requestPool("", class, masklen, v6, pool)
+}
+
+// requestPool allocates a pool as RequestPool does, leasing it to key unless key is empty.
+// The pool already leased to key is preferred when the allocator chooses the pool, and pools leased to other keys are avoided
+// unless nothing else fits.
+func (a *LocalAllocator) requestPool(key, class string, masklen int, v6 bool, pool *net.IPNet) (*net.IPNet, error) {
+	bits := 8 * net.IPv4len
+	if v6 {
+		bits = 8 * net.IPv6len
+	}
+
 	if pool != nil {
-		return nil, fmt.Errorf("LocalAllocator does not (currently) implement specific pool requests")
+		pool = normalizePool(pool)
+		if pool == nil {
+			return nil, invalidf("Only IPv4 and IPv6 subnets can be requested")
+		}
+		masklen, bits = pool.Mask.Size()
 	}
 
-	var i int
+	if masklen < 0 || masklen >= bits {
+		return nil, invalidf("Masklen must be in the interval [0, %d]", bits-1)
+	}
 
-	if masklen < 0 || masklen > 31 {
-		return nil, fmt.Errorf("Masklen must be in the interval [0, 31]")
+	// Networks on the host are read before locking, and only matter when the allocator chooses the pool
+	var avoid []*net.IPNet
+	if pool == nil {
+		var err error
+		if avoid, err = a.avoidNetworks(bits); err != nil {
+			return nil, err
+		}
 	}
 
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
-	// Search up the pool lists for a large enough pool
-	for i = masklen; i >= 0; i-- {
-		s := a.pools[i]
-		if len(s) > 0 {
-			// Pop head
-			pool, a.pools[i] = s[0], s[1:]
+	if pool != nil {
+		return a.requestSpecificPoolNoLock(pool, key)
+	}
+	c, err := a.classNoLock(class)
+	if err != nil {
+		return nil, err
+	}
+	if leased := a.leasedPoolNoLock(key, bits); leased != nil && a.canLeaseNoLock(c, leased, masklen, avoid) {
+		return a.requestSpecificPoolNoLock(leased, key)
+	}
 
+	// Subnets leased to other keys are only chosen when nothing else fits, so they stay free for their keys to get back
+	if leased := a.leasedPoolsNoLock(key, bits); len(leased) > 0 {
+		for _, free := range a.candidatesNoLock(c, masklen, bits) {
+			if pool := avoidingSubpool(free, masklen, append(leased, avoid...)); pool != nil {
+				return a.requestSpecificPoolNoLock(pool, key)
+			}
+		}
+	}
+	if len(avoid) > 0 {
+		return a.requestAvoidingPoolNoLock(c, key, class, masklen, bits, avoid)
+	}
+
+	// Carve the lowest subnet out of the most preferred free pool
+	candidates := a.candidatesNoLock(c, masklen, bits)
+	if len(candidates) == 0 {
+		return nil, exhaustedf("No pool availible to allocate a /%d subnet%s", masklen, inClass(class))
+	}
+	return a.requestSpecificPoolNoLock(normalizePool(&net.IPNet{IP: candidates[0].IP, Mask: net.CIDRMask(masklen, bits)}), key)
+}
+
+// requestSpecificPoolNoLock carves a normalized pool out of the free pool containing it, in whichever class has it.
+// The pool is leased to key unless key is empty.
+func (a *LocalAllocator) requestSpecificPoolNoLock(pool *net.IPNet, key string) (*net.IPNet, error) {
+	masklen, bits := pool.Mask.Size()
+
+	// Search up the pool lists of each class for a free pool which contains the requested one
+	var parent *net.IPNet
+	var pools [][]*net.IPNet
+	var i int
+	for _, c := range a.classes {
+		pools = c.freeLists(bits)
+		for i = masklen; i >= 0; i-- {
+			s := pools[i]
+			for j, poolj := range s {
+				if poolj.Contains(pool.IP) {
+					parent = poolj
+					pools[i] = append(s[:j], s[j+1:]...) // Remove the found pool from the list
+					break
+				}
+			}
+			if parent != nil {
+				break
+			}
+		}
+		if parent != nil {
 			break
 		}
 	}
 
-	// If we didn't find a large enough pool return nil
-	if pool == nil {
-		return nil, fmt.Errorf("No pool availible to allocate a /%d subnet", masklen)
+	if parent == nil {
+		for _, allocated := range a.allocatedPoolsNoLock() {
+			if poolOverlap(pool, allocated) {
+				return nil, conflictf("Pool %s conflicts with allocated pool %s", pool.String(), allocated.String())
+			}
+		}
+		return nil, invalidf("Pool %s is not contained in any free pool", pool.String())
 	}
 
-	// Split the pool until we have the correct size
+	// Split the free pool, keeping the half which holds the request, until we have the correct size
 	for ; i < masklen; i++ {
-		var extrapool *net.IPNet
-		pool, extrapool = splitPool(pool)
-		a.pools[i+1] = append(a.pools[i+1], extrapool)
+		left, right := splitPool(parent)
+		if left.Contains(pool.IP) {
+			parent = left
+			pools[i+1] = append(pools[i+1], right)
+		} else {
+			parent = right
+			pools[i+1] = append(pools[i+1], left)
+		}
 	}
 
-	a.allocated[pool.String()] = true
-	a.signalUpdate()
+	return a.allocatePoolNoLock(parent, key)
+}
+
+// allocatePoolNoLock marks a pool removed from the free lists as allocated, and leases it to key unless key is empty.
+func (a *LocalAllocator) allocatePoolNoLock(pool *net.IPNet, key string) (*net.IPNet, error) {
+	addrs := newAddrBitmap(pool)
+	addrs.reserved = a.reserved
+	a.allocated[pool.String()] = addrs
+	gateway := addrs.ip(a.gatewayNoLock(addrs))
+
+	e := &JournalEntry{Op: opRequestPool, Pool: pool.String(), Addr: gateway.String(), Key: key}
+	for _, r := range addrs.reserved {
+		e.Reserved = append(e.Reserved, r.String())
+	}
+	if err := a.recordNoLock(e); err != nil {
+		a.releasePoolNoLock(pool)
+		return nil, err
+	}
+	if key != "" {
+		a.leaseNoLock(key, pool)
+	}
 	return pool, nil
 }
 
+// ReleasePool returns an allocated pool to the free pools, along with all the addresses allocated in it.
 func (a *LocalAllocator) ReleasePool(pool *net.IPNet) error {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
-	if a.allocated[pool.String()] {
-		a.addPoolNoLock(pool)
+	if _, found := a.allocated[pool.String()]; !found {
+		return notFoundf("Pool was never allocated: %s", pool.String())
+	}
+	if err := a.recordNoLock(&JournalEntry{Op: opReleasePool, Pool: pool.String()}); err != nil {
+		return err
+	}
+	return a.releasePoolNoLock(pool)
+}
+
+func (a *LocalAllocator) releasePoolNoLock(pool *net.IPNet) error {
+	if _, found := a.allocated[pool.String()]; found {
+		// Only return the parts of the pool which are still within the base pools and not excluded
+		a.freeNoLock(normalizePool(pool))
 		delete(a.allocated, pool.String())
 		a.signalUpdate()
 		return nil
 	} else {
-		return fmt.Errorf("Pool was never allocated: %s", pool.String())
+		return notFoundf("Pool was never allocated: %s", pool.String())
 	}
 }
 
-func (a *LocalAllocator) RequestAddress(pool *net.IPNet, ip net.IP) (net.IP, error) {
+// RequestAddress allocates an address from a previously allocated pool.
+// If ip is nil, the lowest free address is chosen, from within subpool if it is non-nil.
+func (a *LocalAllocator) RequestAddress(pool, subpool *net.IPNet, ip net.IP) (net.IP, error) {
+	return a.requestAddress(pool, subpool, ip, "")
+}
+
+// requestAddress allocates an address as RequestAddress does, leasing it to the MAC address mac unless mac is empty.
+// The address already leased to mac is preferred when the allocator chooses the address.
+func (a *LocalAllocator) requestAddress(pool, subpool *net.IPNet, ip net.IP, mac string) (net.IP, error) {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
 	// Make sure we allocated this pool
-	if !a.allocated[pool.String()] {
-		return nil, fmt.Errorf("Pool was never allocated: %s", pool.String())
+	addrs, found := a.allocated[pool.String()]
+	if !found {
+		return nil, notFoundf("Pool was never allocated: %s", pool.String())
 	}
 
 	// Is this a specific ip request or do we choose?
 	if ip != nil {
-		if pool.Contains(ip) && !a.allocated[ip.String()] {
-			a.allocated[ip.String()] = true
+		off, ok := addrs.offset(ip)
+		if ok && off == a.gatewayNoLock(addrs) {
+			return nil, conflictf("Cannot allocate %s from pool %s, it is reserved for the gateway", ip.String(), pool.String())
+		}
+		if ok && addrs.isReserved(off) {
+			return nil, conflictf("Cannot allocate %s from pool %s, it is reserved", ip.String(), pool.String())
+		}
+		if ok && !addrs.isSet(off) {
+			addrs.set(off)
+			if err := a.recordNoLock(&JournalEntry{Op: opRequestAddress, Pool: pool.String(), Addr: ip.String(), Key: mac}); err != nil {
+				addrs.clear(off)
+				return nil, err
+			}
+			if mac != "" {
+				addrs.lease(mac, off)
+			}
 			return ip, nil
 		}
 
-		return nil, fmt.Errorf("Cannot allocate %s from pool %s", ip.String(), pool.String())
+		if !ok {
+			return nil, invalidf("Cannot allocate %s from pool %s", ip.String(), pool.String())
+		}
+		return nil, conflictf("IP address %s is already allocated in pool %s", ip.String(), pool.String())
 	} else {
-		ip = bytop.Copy(pool.IP.To4())
-		if ip == nil {
-			// Not a v4 address
-			return nil, fmt.Errorf("Pool is not a valid IPv4 subet: %s", pool.String())
+		lo, hi := uint64(0), addrs.last
+		if subpool != nil {
+			var ok bool
+			subpool = normalizePool(subpool)
+			if !poolContains(pool, subpool) {
+				return nil, invalidf("Sub-pool %s is not contained in pool %s", subpool.String(), pool.String())
+			}
+			if lo, ok = addrs.offset(subpool.IP); !ok {
+				return nil, invalidf("Sub-pool %s is beyond the addresses tracked in pool %s", subpool.String(), pool.String())
+			}
+			if hi, ok = addrs.offset(bytop.Or(bytop.Not(subpool.Mask, nil), subpool.IP, nil)); !ok {
+				hi = addrs.last
+			}
 		}
 
-		// Find the highest address in the pool (broadcast address)
-		limit := bytop.Or(bytop.Not(pool.Mask, nil), ip, nil)
-		bytop.Add(ip, 1, ip) // Add one to get past network address
-		for ; !bytop.Equal(ip, limit); bytop.Add(ip, 1, ip) {
-			if !a.allocated[ip.String()] {
-				a.allocated[ip.String()] = true
-				a.signalUpdate()
-				return ip, nil
-			}
+		// Skip the network address of the pool, as well as the broadcast address for IPv4
+		// IPv6 has no broadcast address, but the network address is the subnet-router anycast address
+		// The gateway address is also skipped so it is always free for the gateway, as are any reserved addresses
+		v4 := len(addrs.pool.IP) == net.IPv4len
+		gateway := a.gatewayNoLock(addrs)
+		skip := func(off uint64) bool {
+			return off == 0 || (v4 && off == addrs.last) || off == gateway || addrs.isReserved(off)
+		}
+
+		// The address leased to the MAC is reused if it is still free
+		off, ok := addrs.leasedOffset(mac, lo, hi, skip)
+		if !ok {
+			off, ok = addrs.findFree(lo, hi, skip)
+		}
+		if !ok {
+			// Pool must be full
+			return nil, exhaustedf("Pool is exhausted: %s", pool.String())
 		}
 
-		// Pool must be full
-		return nil, fmt.Errorf("Pool is exhausted: %s", pool.String())
+		addrs.set(off)
+		ip = addrs.ip(off)
+		if err := a.recordNoLock(&JournalEntry{Op: opRequestAddress, Pool: pool.String(), Addr: ip.String(), Key: mac}); err != nil {
+			addrs.clear(off)
+			return nil, err
+		}
+		if mac != "" {
+			addrs.lease(mac, off)
+		}
+		return ip, nil
 	}
 }
-func (a *LocalAllocator) ReleaseAddress(ip net.IP) error {
-	ip = ip.To4()
+
+// ReleaseAddress frees an address allocated from the given pool.
+func (a *LocalAllocator) ReleaseAddress(pool *net.IPNet, ip net.IP) error {
 	if ip == nil {
-		return fmt.Errorf("Given IP address is not a valid IPv4 address: %s", ip.String())
+		return invalidf("Given IP address is not a valid IP address")
 	}
 
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
-	if a.allocated[ip.String()] {
-		delete(a.allocated, ip.String())
-		a.signalUpdate()
-		return nil
-	} else {
-		return fmt.Errorf("IP address was never allocated: %s", ip.String())
+	addrs, found := a.allocated[pool.String()]
+	if !found {
+		return notFoundf("Pool was never allocated: %s", pool.String())
+	}
+	off, ok := addrs.offset(ip)
+	if !ok {
+		return invalidf("IP address %s is not in pool %s", ip.String(), pool.String())
+	}
+
+	if !addrs.isSet(off) {
+		return notFoundf("IP address was never allocated: %s", ip.String())
+	}
+	if err := a.recordNoLock(&JournalEntry{Op: opReleaseAddress, Pool: pool.String(), Addr: ip.String()}); err != nil {
+		return err
 	}
+	addrs.clear(off)
+	return nil
 }
 
 func (a *LocalAllocator) Dump() map[string][]string {
@@ -227,31 +467,24 @@ func (a *LocalAllocator) Dump() map[string][]string {
 
 	dump := make(map[string][]string)
 
-	for _, s := range a.pools {
-		for _, pool := range s {
-			dump["free"] = append(dump["free"], pool.String())
-		}
+	for _, pool := range a.freePoolsNoLock() {
+		dump["free"] = append(dump["free"], pool.String())
 	}
 
-	for val, _ := range a.allocated {
+	for val, addrs := range a.allocated {
 		dump["allocated"] = append(dump["allocated"], val)
+		dump["addresses"] = append(dump["addresses"], addrs.addrs()...)
 	}
 
-	return dump
-}
-
-// Save the allocator's current state to a file
-func (a *LocalAllocator) save() error {
-	dump := a.Dump()
+	for _, pool := range a.basePoolsNoLock() {
+		dump["base"] = append(dump["base"], pool.String())
+	}
 
-	b := bytes.Buffer{}
-	e := gob.NewEncoder(&b)
-	err := e.Encode(dump)
-	if err != nil {
-		return err
+	for _, pool := range a.excluded {
+		dump["excluded"] = append(dump["excluded"], pool.String())
 	}
 
-	return ioutil.WriteFile(localBackup, b.Bytes(), 0644)
+	return dump
 }
 
 func (a *LocalAllocator) signalUpdate() {
@@ -259,6 +492,8 @@ func (a *LocalAllocator) signalUpdate() {
 	a.update.Signal()
 }
 
+// autosave saves a snapshot after updates, at most once every compactInterval.
+// Changes made in between are kept durable by the journal.
 func (a *LocalAllocator) autosave() error {
 	for {
 		a.update.L.Lock()
@@ -268,58 +503,23 @@ func (a *LocalAllocator) autosave() error {
 		a.updated = false
 		a.update.L.Unlock()
 
-		a.save()
-	}
-}
-
-// Load a saved allocator state
-func (a *LocalAllocator) load() error {
-	data, err := ioutil.ReadFile(localBackup)
-	if err != nil {
-		return err
-	}
-
-	b := bytes.Buffer{}
-	b.Write(data)
-
-	dump := make(map[string][]string)
-	d := gob.NewDecoder(&b)
-	err = d.Decode(&dump)
-	if err != nil {
-		return err
-	}
-
-	// Set this object to the initial state
-	a.init()
-
-	a.lock.Lock()
-	defer a.lock.Unlock()
-
-	// Set the allocator state to the loaded dump
-	for _, str := range dump["free"] {
-		_, pool, err := net.ParseCIDR(str)
-		if err != nil {
-			return err
-		}
-		pool = normalizePool(pool)
-		if pool == nil {
-			return fmt.Errorf("Read non-v4 IP address")
+		if err := a.save(); err != nil {
+			atomic.AddUint64(&a.saveFailures, 1)
 		}
-
-		masklen, _ := pool.Mask.Size()
-		a.pools[masklen] = append(a.pools[masklen], pool)
-	}
-
-	for _, str := range dump["allocated"] {
-		a.allocated[str] = true
+		time.Sleep(compactInterval)
 	}
-
-	return nil
 }
 
 // Creates a copy of an ipnet, and ensures the IP component is the network address
+// The IP is made the same length as the mask so IPv4 pools are always 4 bytes and IPv6 pools 16
 func normalizePool(ipnet *net.IPNet) *net.IPNet {
-	ip := ipnet.IP.To4()
+	var ip net.IP
+	switch len(ipnet.Mask) {
+	case net.IPv4len:
+		ip = ipnet.IP.To4()
+	case net.IPv6len:
+		ip = ipnet.IP.To16()
+	}
 	if ip == nil {
 		return nil
 	}
@@ -356,7 +556,7 @@ func expandPool(pool *net.IPNet) *net.IPNet {
 func splitPool(pool *net.IPNet) (*net.IPNet, *net.IPNet) {
 	masklen, addrlen := pool.Mask.Size()
 
-	if addrlen != 32 || masklen >= 32 {
+	if masklen >= addrlen {
 		return nil, nil
 	}
 
@@ -370,14 +570,25 @@ func splitPool(pool *net.IPNet) (*net.IPNet, *net.IPNet) {
 	return left, right
 }
 
+// Checks if the inner pool lies entirely within the outer pool
+func poolContains(outer, inner *net.IPNet) bool {
+	if outer == nil || inner == nil {
+		return false
+	}
+
+	outerlen, outerbits := outer.Mask.Size()
+	innerlen, innerbits := inner.Mask.Size()
+	return outerbits == innerbits && outerlen <= innerlen && outer.Contains(inner.IP)
+}
+
 func poolOverlap(a, b *net.IPNet) bool {
 	if a == nil || b == nil {
 		return false
 	}
 
-	if a.Contains(bytop.And(b.IP.To4(), b.Mask, nil)) { // Check if the network addr of b is in a
+	if a.Contains(b.IP.Mask(b.Mask)) { // Check if the network addr of b is in a
 		return true
-	} else if b.Contains(bytop.And(a.IP.To4(), a.Mask, nil)) { // Check if the network addr of a is in b
+	} else if b.Contains(a.IP.Mask(a.Mask)) { // Check if the network addr of a is in b
 		return true
 	} else {
 		return false
@@ -0,0 +1,171 @@
+package allocator
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"net"
+)
+
+// addrBitmap tracks the allocated addresses of a pool by their offset from the network address.
+// The bitmap words are stored sparsely, so even an IPv6 /64 only costs memory for the words in use.
+// Pools larger than 2^64 addresses only have their first 2^64 addresses tracked.
+type addrBitmap struct {
+	pool  *net.IPNet
+	words map[uint64]uint64
+	count uint64
+	last  uint64 // Highest offset in the pool
+	hint  uint64 // Every offset below hint is allocated or skipped, so searches may start here
+
+	// The gateway offset is reserved for the gateway, and is chosen when first needed
+	gateway    uint64
+	hasGateway bool
+
+	// Reserved offsets are never assigned to containers
+	reserved []OffsetRange
+
+	// Offsets last assigned to each MAC address, kept after the address is released
+	leases map[string]uint64
+}
+
+// newAddrBitmap creates an empty bitmap for a normalized pool.
+func newAddrBitmap(pool *net.IPNet) *addrBitmap {
+	masklen, addrlen := pool.Mask.Size()
+	last := uint64(math.MaxUint64)
+	if hostbits := uint(addrlen - masklen); hostbits < 64 {
+		last = 1<<hostbits - 1
+	}
+	return &addrBitmap{pool: pool, words: make(map[uint64]uint64), last: last}
+}
+
+// offset gives the offset of ip within the pool, or false if it is not in the tracked part of the pool.
+func (b *addrBitmap) offset(ip net.IP) (uint64, bool) {
+	if !b.pool.Contains(ip) {
+		return 0, false
+	}
+	if len(b.pool.IP) == net.IPv4len {
+		ip = ip.To4()
+	} else {
+		ip = ip.To16()
+	}
+
+	// The host part of the address is the offset, and must fit in the last 8 bytes
+	host := make([]byte, len(ip))
+	for i := range ip {
+		host[i] = ip[i] &^ b.pool.Mask[i]
+	}
+	for len(host) > 8 {
+		if host[0] != 0 {
+			return 0, false
+		}
+		host = host[1:]
+	}
+	padded := make([]byte, 8)
+	copy(padded[8-len(host):], host)
+	return binary.BigEndian.Uint64(padded), true
+}
+
+// ip gives the address at an offset within the pool.
+func (b *addrBitmap) ip(off uint64) net.IP {
+	padded := make([]byte, 8)
+	binary.BigEndian.PutUint64(padded, off)
+
+	ip := make(net.IP, len(b.pool.IP))
+	copy(ip, b.pool.IP)
+	for i := 1; i <= 8 && i <= len(ip); i++ {
+		ip[len(ip)-i] |= padded[8-i]
+	}
+	return ip
+}
+
+func (b *addrBitmap) isSet(off uint64) bool {
+	return b.words[off/64]&(1<<(off%64)) != 0
+}
+
+func (b *addrBitmap) set(off uint64) {
+	if !b.isSet(off) {
+		b.words[off/64] |= 1 << (off % 64)
+		b.count++
+	}
+}
+
+func (b *addrBitmap) clear(off uint64) {
+	if !b.isSet(off) {
+		return
+	}
+
+	word := b.words[off/64] &^ (1 << (off % 64))
+	if word == 0 {
+		delete(b.words, off/64)
+	} else {
+		b.words[off/64] = word
+	}
+	b.count--
+	b.unskip(off)
+}
+
+// unskip lets future searches consider an offset which was previously allocated or skipped.
+func (b *addrBitmap) unskip(off uint64) {
+	if off < b.hint {
+		b.hint = off
+	}
+}
+
+// findFree finds the lowest unallocated offset in [lo, hi] for which skip returns false.
+func (b *addrBitmap) findFree(lo, hi uint64, skip func(uint64) bool) (uint64, bool) {
+	fromHint := lo <= b.hint
+	if fromHint {
+		lo = b.hint
+	}
+
+	for off := lo; off <= hi; {
+		// Jump to the next clear bit in this word, if there is one
+		word := b.words[off/64] >> (off % 64)
+		n := uint64(bits.TrailingZeros64(^word))
+		if n >= 64-off%64 {
+			// The rest of the word is full
+			next := (off/64 + 1) * 64
+			if next == 0 {
+				break // Wrapped around the end of the offset space
+			}
+			off = next
+			continue
+		}
+
+		off += n
+		if off > hi {
+			break
+		}
+		if !skip(off) {
+			if fromHint {
+				b.hint = off + 1
+			}
+			return off, true
+		}
+		if off == hi {
+			break
+		}
+		off++
+	}
+	return 0, false
+}
+
+// each calls fn with the offset of every allocated address.
+func (b *addrBitmap) each(fn func(uint64)) {
+	for w, word := range b.words {
+		for word != 0 {
+			i := uint64(bits.TrailingZeros64(word))
+			fn(w*64 + i)
+			word &^= 1 << i
+		}
+	}
+}
+
+// addrs gives every allocated address in string form.
+func (b *addrBitmap) addrs() []string {
+	var res []string
+	b.each(func(off uint64) {
+		res = append(res, b.ip(off).String())
+	})
+	return res
+}
@@ -0,0 +1,121 @@
+package allocator
+
+import (
+	"math"
+	"net"
+	"testing"
+)
+
+func TestFindFree(t *testing.T) {
+	none := func(uint64) bool { return false }
+	skipZero := func(off uint64) bool { return off == 0 }
+
+	tests := []struct {
+		name     string
+		pool     string
+		set      []uint64
+		hint     uint64
+		lo, hi   uint64
+		skip     func(uint64) bool
+		want     uint64
+		wantOK   bool
+		wantHint uint64
+	}{
+		{name: "empty pool", pool: "10.0.0.0/28", hi: 15, skip: skipZero, want: 1, wantOK: true, wantHint: 2},
+		{name: "starts at the hint", pool: "10.0.0.0/28", set: []uint64{1, 2, 3}, hint: 4, hi: 15, skip: skipZero, want: 4, wantOK: true, wantHint: 5},
+		{name: "takes the hint when it is free", pool: "10.0.0.0/28", set: []uint64{1, 3}, hint: 2, hi: 15, skip: skipZero, want: 2, wantOK: true, wantHint: 3},
+		{name: "skips full words", pool: "10.0.0.0/24", set: rangeOffsets(0, 130), hi: 255, skip: none, want: 131, wantOK: true, wantHint: 132},
+		{name: "full up to hi", pool: "10.0.0.0/28", set: rangeOffsets(1, 3), hi: 3, skip: skipZero, wantOK: false},
+		{name: "only skipped offsets free", pool: "10.0.0.0/30", set: []uint64{1, 2}, hi: 3, skip: func(off uint64) bool { return off == 0 || off == 3 }, wantOK: false},
+		{name: "range above the hint leaves it alone", pool: "10.0.0.0/24", lo: 16, hi: 31, skip: none, want: 16, wantOK: true, wantHint: 0},
+		{name: "last offset of the offset space", pool: "fd00::/64", set: rangeOffsets(math.MaxUint64-63, math.MaxUint64-1), lo: math.MaxUint64 - 63, hi: math.MaxUint64, skip: none, want: math.MaxUint64, wantOK: true},
+		{name: "full last word does not wrap around", pool: "fd00::/64", set: rangeOffsets(math.MaxUint64-63, math.MaxUint64), lo: math.MaxUint64 - 63, hi: math.MaxUint64, skip: none, wantOK: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newAddrBitmap(normalizePool(mustParsePool(t, test.pool)))
+			for _, off := range test.set {
+				b.set(off)
+			}
+			b.hint = test.hint
+
+			got, ok := b.findFree(test.lo, test.hi, test.skip)
+			if ok != test.wantOK || (ok && got != test.want) {
+				t.Fatalf("findFree(%d, %d) = %d, %t, want %d, %t", test.lo, test.hi, got, ok, test.want, test.wantOK)
+			}
+			if ok && test.lo <= test.hint && b.hint != test.wantHint {
+				t.Errorf("hint = %d, want %d", b.hint, test.wantHint)
+			}
+			if ok && test.lo > test.hint && b.hint != test.hint {
+				t.Errorf("hint moved to %d by a search starting above it", b.hint)
+			}
+		})
+	}
+}
+
+func TestClearMovesHint(t *testing.T) {
+	b := newAddrBitmap(normalizePool(mustParsePool(t, "10.0.0.0/28")))
+	skip := func(off uint64) bool { return off == 0 }
+	for i := 0; i < 5; i++ {
+		allocateLowest(t, b, skip)
+	}
+
+	b.clear(2)
+	if off := allocateLowest(t, b, skip); off != 2 {
+		t.Errorf("got offset %d after clearing 2, want 2", off)
+	}
+	if off := allocateLowest(t, b, skip); off != 6 {
+		t.Errorf("got offset %d, want 6", off)
+	}
+}
+
+func TestOffsetRoundTrip(t *testing.T) {
+	tests := []struct {
+		pool string
+		ip   string
+		off  uint64
+		ok   bool
+	}{
+		{"10.0.0.0/28", "10.0.0.0", 0, true},
+		{"10.0.0.0/28", "10.0.0.15", 15, true},
+		{"10.0.0.0/28", "10.0.0.16", 0, false},
+		{"fd00::/64", "fd00::1:0:0:5", 1<<48 + 5, true},
+		{"fd00::/64", "fd00::ffff:ffff:ffff:ffff", math.MaxUint64, true},
+		{"fd00::/56", "fd00:0:0:ff::1", 0, false}, // Beyond the tracked 2^64 addresses
+	}
+
+	for _, test := range tests {
+		b := newAddrBitmap(normalizePool(mustParsePool(t, test.pool)))
+		ip := net.ParseIP(test.ip)
+		off, ok := b.offset(ip)
+		if ok != test.ok || (ok && off != test.off) {
+			t.Errorf("offset(%s) in %s = %d, %t, want %d, %t", test.ip, test.pool, off, ok, test.off, test.ok)
+			continue
+		}
+		if ok && !b.ip(off).Equal(ip) {
+			t.Errorf("ip(%d) in %s = %s, want %s", off, test.pool, b.ip(off), test.ip)
+		}
+	}
+}
+
+// allocateLowest allocates the lowest free offset of the whole pool, as RequestAddress does.
+func allocateLowest(t *testing.T, b *addrBitmap, skip func(uint64) bool) uint64 {
+	t.Helper()
+	off, ok := b.findFree(0, b.last, skip)
+	if !ok {
+		t.Fatal("pool is full")
+	}
+	b.set(off)
+	return off
+}
+
+func rangeOffsets(lo, hi uint64) []uint64 {
+	var res []uint64
+	for off := lo; ; off++ {
+		res = append(res, off)
+		if off == hi {
+			return res
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package allocator
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltBucket        = []byte("mini-ipam")
+	boltJournalBucket = []byte("journal")
+	boltStateKey      = []byte("state")
+)
+
+// BoltStore is a Store which saves the state in an embedded BoltDB database.
+// Each update is a fsynced transaction, and the database file is locked while the store is open.
+type BoltStore struct {
+	db       *bolt.DB
+	watchers watchers
+}
+
+// NewBoltStore opens or creates the database at path.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open state database %s, is another instance running? %s", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltBucket, boltJournalBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Load() (*State, error) {
+	var st *State
+	err := s.db.View(func(tx *bolt.Tx) (err error) {
+		st, err = readBoltState(tx)
+		return err
+	})
+	return st, err
+}
+
+func (s *BoltStore) Apply(m Mutation) error {
+	var st *State
+	err := s.db.Update(func(tx *bolt.Tx) (err error) {
+		st, err = readBoltState(tx)
+		if os.IsNotExist(err) {
+			st, err = &State{Version: StateVersion}, nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := m(st); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltBucket).Put(boltStateKey, data)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.watchers.notify(st)
+	return nil
+}
+
+func (s *BoltStore) Watch(stop <-chan struct{}) <-chan *State {
+	return s.watchers.add(stop)
+}
+
+// Append stores the entry keyed by its sequence number, in its own transaction.
+func (s *BoltStore) Append(e *JournalEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltJournalBucket).Put(boltSeqKey(e.Seq), data)
+	})
+}
+
+func (s *BoltStore) Entries() ([]*JournalEntry, error) {
+	var entries []*JournalEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltJournalBucket).ForEach(func(k, v []byte) error {
+			e := &JournalEntry{}
+			if err := json.Unmarshal(v, e); err != nil {
+				return fmt.Errorf("Failed to parse journal entry %d: %s", binary.BigEndian.Uint64(k), err)
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+func (s *BoltStore) Compact(seq uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltJournalBucket).Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= seq; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close closes the database.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// boltSeqKey encodes a journal sequence number as a key, which sorts in sequence order.
+func boltSeqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// readBoltState reads the state saved in the database.
+func readBoltState(tx *bolt.Tx) (*State, error) {
+	data := tx.Bucket(boltBucket).Get(boltStateKey)
+	if data == nil {
+		return nil, &os.PathError{Op: "load", Path: tx.DB().Path(), Err: os.ErrNotExist}
+	}
+
+	st := &State{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("Failed to parse state database %s: %s", tx.DB().Path(), err)
+	}
+	return st, nil
+}
@@ -0,0 +1,105 @@
+package allocator
+
+import (
+	"net"
+	"regexp"
+	"sort"
+)
+
+// DefaultClass is the pool class of the base pools added without naming a class, and used when a request names none.
+const DefaultClass = "default"
+
+var classNameRe = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
+// poolClass is a named group of base pools with its own free lists, so networks can draw from different ranges.
+// AddPool and the reconciles refuse base pools which overlap those of another class, so every free range belongs to exactly one class.
+type poolClass struct {
+	pools  [][]*net.IPNet // Free IPv4 pools indexed by mask length
+	pools6 [][]*net.IPNet // Free IPv6 pools indexed by mask length
+	base   []*net.IPNet   // Pools added to the class, which bound what is returned to its free lists
+}
+
+func newPoolClass() *poolClass {
+	return &poolClass{
+		pools:  make([][]*net.IPNet, 8*net.IPv4len),
+		pools6: make([][]*net.IPNet, 8*net.IPv6len),
+	}
+}
+
+// ValidClassName reports whether name may be used as the name of a pool class.
+func ValidClassName(name string) bool {
+	return classNameRe.MatchString(name)
+}
+
+// freeLists gives the free pool lists for the address family with the given address length in bits.
+func (c *poolClass) freeLists(bits int) [][]*net.IPNet {
+	if bits == 8*net.IPv6len {
+		return c.pools6
+	}
+	return c.pools
+}
+
+// freePools gives all of the free IPv4 and IPv6 pools of the class.
+func (c *poolClass) freePools() []*net.IPNet {
+	var res []*net.IPNet
+	for _, pools := range [][][]*net.IPNet{c.pools, c.pools6} {
+		for _, s := range pools {
+			res = append(res, s...)
+		}
+	}
+	return res
+}
+
+// classNoLock gives the pool class with the given name.
+func (a *LocalAllocator) classNoLock(name string) (*poolClass, error) {
+	c, found := a.classes[name]
+	if !found {
+		return nil, notFoundf("Unknown pool class: %s", name)
+	}
+	return c, nil
+}
+
+// classOrNewNoLock gives the pool class with the given name, creating it if there is none.
+func (a *LocalAllocator) classOrNewNoLock(name string) *poolClass {
+	c, found := a.classes[name]
+	if !found {
+		c = newPoolClass()
+		a.classes[name] = c
+	}
+	return c
+}
+
+// classNamesNoLock gives the names of the pool classes in sorted order.
+func (a *LocalAllocator) classNamesNoLock() []string {
+	var names []string
+	for name := range a.classes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Classes gives the names of the pool classes of the allocator, including the default class.
+func (a *LocalAllocator) Classes() []string {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.classNamesNoLock()
+}
+
+// basePoolsNoLock gives the base pools of every class.
+func (a *LocalAllocator) basePoolsNoLock() []*net.IPNet {
+	var res []*net.IPNet
+	for _, name := range a.classNamesNoLock() {
+		res = append(res, a.classes[name].base...)
+	}
+	return res
+}
+
+// inClass describes the class of a request in an error message, saying nothing for the default class.
+func inClass(name string) string {
+	if name == DefaultClass {
+		return ""
+	}
+	return " in pool class " + name
+}
@@ -0,0 +1,58 @@
+package allocator
+
+import "fmt"
+
+// ErrExhausted is returned when there is no free space left to satisfy a request.
+type ErrExhausted string
+
+func (e ErrExhausted) Error() string {
+	return string(e)
+}
+
+// ErrConflict is returned when a request collides with something already allocated or reserved.
+type ErrConflict string
+
+func (e ErrConflict) Error() string {
+	return string(e)
+}
+
+// ErrNotFound is returned when a request refers to a pool, address, or class the allocator does not have.
+type ErrNotFound string
+
+func (e ErrNotFound) Error() string {
+	return string(e)
+}
+
+// ErrInvalidArgument is returned when a request can never succeed as given, such as an address outside of its pool.
+type ErrInvalidArgument string
+
+func (e ErrInvalidArgument) Error() string {
+	return string(e)
+}
+
+// ErrContention is returned when shared state kept changing underneath a request, which may succeed if retried.
+type ErrContention string
+
+func (e ErrContention) Error() string {
+	return string(e)
+}
+
+func exhaustedf(format string, args ...interface{}) error {
+	return ErrExhausted(fmt.Sprintf(format, args...))
+}
+
+func conflictf(format string, args ...interface{}) error {
+	return ErrConflict(fmt.Sprintf(format, args...))
+}
+
+func notFoundf(format string, args ...interface{}) error {
+	return ErrNotFound(fmt.Sprintf(format, args...))
+}
+
+func invalidf(format string, args ...interface{}) error {
+	return ErrInvalidArgument(fmt.Sprintf(format, args...))
+}
+
+func contentionf(format string, args ...interface{}) error {
+	return ErrContention(fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,149 @@
+package allocator
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// OffsetRange is an inclusive range of address offsets within a pool, where offset 0 is the network address.
+type OffsetRange struct {
+	First, Last uint64
+}
+
+// ParseOffsetRange parses an offset such as "5" or a range of offsets such as "1-9".
+func ParseOffsetRange(str string) (OffsetRange, error) {
+	parts := strings.SplitN(str, "-", 2)
+	first, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 64)
+	if err != nil {
+		return OffsetRange{}, fmt.Errorf("Invalid address offset range %q", str)
+	}
+	last := first
+	if len(parts) == 2 {
+		if last, err = strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 64); err != nil || last < first {
+			return OffsetRange{}, fmt.Errorf("Invalid address offset range %q", str)
+		}
+	}
+	return OffsetRange{First: first, Last: last}, nil
+}
+
+func (r OffsetRange) String() string {
+	if r.First == r.Last {
+		return strconv.FormatUint(r.First, 10)
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// SetReservedOffsets sets the address offsets which are never assigned in pools allocated from now on.
+// The reserved offsets of a pool are fixed when it is allocated, so changing this does not affect existing pools.
+func (a *LocalAllocator) SetReservedOffsets(ranges []OffsetRange) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.reserved = append([]OffsetRange(nil), ranges...)
+}
+
+// SetExcluded sets the subnets which are never handed out, and removes them from the free pools.
+// Subnets which are no longer excluded are returned to the free pools if they lie within a base pool.
+// Allocated pools overlapping an excluded subnet are left untouched, and are returned.
+func (a *LocalAllocator) SetExcluded(pools []*net.IPNet) ([]*net.IPNet, error) {
+	var excluded []*net.IPNet
+	for _, pool := range pools {
+		norm := normalizePool(pool)
+		if norm == nil {
+			return nil, invalidf("Only IPv4 and IPv6 subnets can be excluded")
+		}
+		excluded = append(excluded, norm)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	prev := a.snapshotNoLock()
+	a.excluded = excluded
+	for _, c := range a.classes {
+		a.reconcileNoLock(c, c.base)
+	}
+
+	var conflicts []*net.IPNet
+	for _, pool := range a.allocatedPoolsNoLock() {
+		for _, ex := range excluded {
+			if poolOverlap(pool, ex) {
+				conflicts = append(conflicts, pool)
+				break
+			}
+		}
+	}
+
+	e := &JournalEntry{Op: opExclude}
+	for _, pool := range excluded {
+		e.Pools = append(e.Pools, pool.String())
+	}
+	if err := a.recordNoLock(e); err != nil {
+		a.rollbackNoLock(prev)
+		return nil, err
+	}
+	return conflicts, nil
+}
+
+// freeNoLock returns the parts of a normalized pool which are within the base pools of a class and not excluded to the free pools of that class.
+func (a *LocalAllocator) freeNoLock(pool *net.IPNet) {
+	for _, c := range a.classes {
+		keep, _ := clipPool(pool, c.base)
+		for _, p := range keep {
+			_, allowed := clipPool(p, a.excluded)
+			for _, q := range allowed {
+				a.addPoolNoLock(c, q)
+			}
+		}
+	}
+}
+
+// isReserved reports whether an offset is in one of the reserved ranges of the pool.
+func (b *addrBitmap) isReserved(off uint64) bool {
+	for _, r := range b.reserved {
+		if off >= r.First && off <= r.Last {
+			return true
+		}
+	}
+	return false
+}
+
+// nextUnreserved gives the lowest offset in [lo, hi] which is not reserved.
+func (b *addrBitmap) nextUnreserved(lo, hi uint64) (uint64, bool) {
+	for lo <= hi {
+		moved := false
+		for _, r := range b.reserved {
+			if lo >= r.First && lo <= r.Last {
+				if r.Last >= hi {
+					return 0, false
+				}
+				lo, moved = r.Last+1, true
+			}
+		}
+		if !moved {
+			return lo, true
+		}
+	}
+	return 0, false
+}
+
+// prevUnreserved gives the highest offset in [lo, hi] which is not reserved.
+func (b *addrBitmap) prevUnreserved(lo, hi uint64) (uint64, bool) {
+	for lo <= hi {
+		moved := false
+		for _, r := range b.reserved {
+			if hi >= r.First && hi <= r.Last {
+				if r.First <= lo {
+					return 0, false
+				}
+				hi, moved = r.First-1, true
+			}
+		}
+		if !moved {
+			return hi, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package allocator
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile opens the file at path and takes an exclusive lock on it.
+// It fails immediately if another process holds the lock, which is released when the file is closed.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// syncDir flushes the directory entry so a rename within it is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
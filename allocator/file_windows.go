@@ -0,0 +1,26 @@
+package allocator
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile opens the file at path without sharing, which prevents any other process opening it.
+// The lock is released when the file is closed.
+func lockFile(path string) (*os.File, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := syscall.CreateFile(p, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(h), path), nil
+}
+
+// syncDir is a no-op, since Windows does not support syncing directories.
+func syncDir(dir string) error {
+	return nil
+}
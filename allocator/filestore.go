@@ -0,0 +1,211 @@
+package allocator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	lockFileName    = "lock"
+	journalFileName = "journal.log"
+)
+
+// FileStore is a Store which saves the state as JSON in a directory.
+// Journal entries are appended to a separate file as lines of JSON.
+// The directory is locked so that no other FileStore may use it until Close is called.
+type FileStore struct {
+	dir      string
+	dirLock  *os.File
+	journal  *os.File // Opened for appending on first use
+	lock     sync.Mutex
+	watchers watchers
+}
+
+// NewFileStore creates the state directory if needed and takes the lock on it.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := lockFile(filepath.Join(dir, lockFileName))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to lock state directory %s, is another instance running? %s", dir, err)
+	}
+	return &FileStore{dir: dir, dirLock: f}, nil
+}
+
+// Load reads the saved state, migrating it from the gob dump written by older versions if needed.
+func (s *FileStore) Load() (*State, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.loadNoLock()
+}
+
+func (s *FileStore) loadNoLock() (*State, error) {
+	st, err := readStateFile(filepath.Join(s.dir, stateFileName))
+	if !os.IsNotExist(err) {
+		return st, err
+	}
+
+	st, err = readGobStateFile(filepath.Join(s.dir, gobStateFileName))
+	if os.IsNotExist(err) {
+		// Pick up state left in the temp dir by older versions, if it survived
+		st, err = readGobStateFile(legacyStateFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Rewrite the state in the current format
+	return st, s.writeNoLock(st)
+}
+
+func (s *FileStore) Apply(m Mutation) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st, err := s.loadNoLock()
+	if os.IsNotExist(err) {
+		st, err = &State{Version: StateVersion}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := m(st); err != nil {
+		return err
+	}
+
+	if err := s.writeNoLock(st); err != nil {
+		return err
+	}
+	s.watchers.notify(st)
+	return nil
+}
+
+func (s *FileStore) writeNoLock(st *State) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, stateFileName), append(data, '\n'), 0644)
+}
+
+func (s *FileStore) Watch(stop <-chan struct{}) <-chan *State {
+	return s.watchers.add(stop)
+}
+
+// Append writes the entry to the end of the journal file and syncs it to disk.
+func (s *FileStore) Append(e *JournalEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.journal == nil {
+		f, err := os.OpenFile(filepath.Join(s.dir, journalFileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		if err := syncDir(s.dir); err != nil {
+			f.Close()
+			return err
+		}
+		s.journal = f
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	info, err := s.journal.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := s.journal.Write(append(data, '\n')); err != nil {
+		// Cut off whatever part was written, so the next entry does not start on the same line
+		s.journal.Truncate(info.Size())
+		return err
+	}
+	return s.journal.Sync()
+}
+
+func (s *FileStore) Entries() ([]*JournalEntry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.entriesNoLock()
+}
+
+// entriesNoLock reads the journal file, cutting off a torn last line.
+func (s *FileStore) entriesNoLock() ([]*JournalEntry, error) {
+	path := filepath.Join(s.dir, journalFileName)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A last line with no newline means the driver stopped part way through writing it
+	// The change was never acknowledged, so it is dropped, and removed so later entries are not appended to it
+	if end := bytes.LastIndexByte(data, '\n') + 1; end < len(data) {
+		if err := os.Truncate(path, int64(end)); err != nil {
+			return nil, fmt.Errorf("Failed to remove torn entry from journal %s: %s", path, err)
+		}
+		data = data[:end]
+	}
+
+	var entries []*JournalEntry
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		e := &JournalEntry{}
+		if err := json.Unmarshal(line, e); err != nil {
+			return nil, fmt.Errorf("Failed to parse journal %s line %d: %s", path, i+1, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Compact rewrites the journal file with only the entries after seq.
+func (s *FileStore) Compact(seq uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entries, err := s.entriesNoLock()
+	if err != nil {
+		return err
+	}
+	entries = compactEntries(entries, seq)
+
+	var buf bytes.Buffer
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(data, '\n'))
+	}
+
+	// The append handle refers to the old file, so it is reopened on the next append
+	if s.journal != nil {
+		s.journal.Close()
+		s.journal = nil
+	}
+	return writeFileAtomic(filepath.Join(s.dir, journalFileName), buf.Bytes(), 0644)
+}
+
+// Close releases the lock on the state directory.
+func (s *FileStore) Close() error {
+	if s.journal != nil {
+		s.journal.Close()
+	}
+	return s.dirLock.Close()
+}
@@ -0,0 +1,120 @@
+package allocator
+
+import (
+	"fmt"
+	"net"
+)
+
+// GatewayPosition selects which address of a pool is reserved for its gateway.
+type GatewayPosition int
+
+const (
+	// GatewayFirst reserves the first usable address of each pool for the gateway.
+	GatewayFirst GatewayPosition = iota
+	// GatewayLast reserves the last usable address of each pool for the gateway.
+	GatewayLast
+)
+
+// ParseGatewayPosition parses "first" or "last" into a GatewayPosition.
+func ParseGatewayPosition(str string) (GatewayPosition, error) {
+	switch str {
+	case "first":
+		return GatewayFirst, nil
+	case "last":
+		return GatewayLast, nil
+	default:
+		return GatewayFirst, fmt.Errorf("Gateway position must be \"first\" or \"last\": %s", str)
+	}
+}
+
+func (p GatewayPosition) String() string {
+	if p == GatewayLast {
+		return "last"
+	}
+	return "first"
+}
+
+// SetGatewayPosition sets which address is reserved for the gateway of pools which do not yet have one.
+// The gateway of a pool is fixed once chosen, so changing this does not affect existing pools.
+func (a *LocalAllocator) SetGatewayPosition(pos GatewayPosition) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.gateway = pos
+}
+
+// gatewayNoLock gives the offset reserved for the gateway of a pool, choosing it if needed.
+func (a *LocalAllocator) gatewayNoLock(addrs *addrBitmap) uint64 {
+	if !addrs.hasGateway {
+		// IPv4 pools end with the broadcast address, which cannot be used
+		first, last := uint64(1), addrs.last
+		if len(addrs.pool.IP) == net.IPv4len && last > 1 {
+			last--
+		}
+
+		// Take the first or last address which is not reserved, falling back to the first if all of them are
+		var off uint64
+		var ok bool
+		if a.gateway == GatewayLast {
+			off, ok = addrs.prevUnreserved(first, last)
+		} else {
+			off, ok = addrs.nextUnreserved(first, last)
+		}
+		if !ok {
+			off = first
+		}
+		addrs.gateway, addrs.hasGateway = off, true
+		a.signalUpdate()
+	}
+	return addrs.gateway
+}
+
+// RequestGateway allocates the gateway address of a previously allocated pool.
+// If ip is nil, the address reserved for the gateway is allocated.
+// Otherwise ip is allocated and reserved as the gateway in place of the previous address, which is released.
+// The new gateway must not be the network address, the IPv4 broadcast address, or a reserved address.
+func (a *LocalAllocator) RequestGateway(pool *net.IPNet, ip net.IP) (net.IP, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// Make sure we allocated this pool
+	addrs, found := a.allocated[pool.String()]
+	if !found {
+		return nil, notFoundf("Pool was never allocated: %s", pool.String())
+	}
+
+	off := a.gatewayNoLock(addrs)
+	if ip != nil {
+		var ok bool
+		if off, ok = addrs.offset(ip); !ok {
+			return nil, invalidf("Cannot allocate %s from pool %s", ip.String(), pool.String())
+		}
+		// A new gateway may only be an address which could be given to a container
+		if off != addrs.gateway {
+			if off == 0 || (len(addrs.pool.IP) == net.IPv4len && addrs.last > 1 && off == addrs.last) {
+				return nil, invalidf("Cannot use %s as the gateway of pool %s, it is the network or broadcast address", ip.String(), pool.String())
+			}
+			if addrs.isReserved(off) {
+				return nil, conflictf("Cannot use %s as the gateway of pool %s, it is reserved", ip.String(), pool.String())
+			}
+		}
+	}
+
+	if addrs.isSet(off) {
+		return nil, conflictf("Gateway address %s is already allocated in pool %s", addrs.ip(off).String(), pool.String())
+	}
+
+	ip = addrs.ip(off)
+	if err := a.recordNoLock(&JournalEntry{Op: opRequestGateway, Pool: pool.String(), Addr: ip.String()}); err != nil {
+		return nil, err
+	}
+
+	if off != addrs.gateway {
+		// Release the old gateway address, and let address searches consider it again
+		addrs.clear(addrs.gateway)
+		addrs.unskip(addrs.gateway)
+		addrs.gateway = off
+	}
+	addrs.set(off)
+	return ip, nil
+}
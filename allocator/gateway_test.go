@@ -0,0 +1,115 @@
+package allocator
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestRequestGateway(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(t *testing.T, a *LocalAllocator, pool *net.IPNet)
+		gateway  string // Requested gateway, or "" for the default
+		want     string
+		wantErr  error
+		wantNext string // Address chosen by the next RequestAddress
+	}{
+		{name: "default", want: "10.0.0.1", wantNext: "10.0.0.2"},
+		{name: "explicit", gateway: "10.0.0.10", want: "10.0.0.10", wantNext: "10.0.0.1"},
+		{name: "explicit default address", gateway: "10.0.0.1", want: "10.0.0.1", wantNext: "10.0.0.2"},
+		{
+			name: "re-pointed",
+			setup: func(t *testing.T, a *LocalAllocator, pool *net.IPNet) {
+				if _, err := a.RequestGateway(pool, nil); err != nil {
+					t.Fatal(err)
+				}
+			},
+			gateway: "10.0.0.10", want: "10.0.0.10", wantNext: "10.0.0.1",
+		},
+		{name: "network address", gateway: "10.0.0.0", wantErr: ErrInvalidArgument(""), wantNext: "10.0.0.2"},
+		{name: "broadcast address", gateway: "10.0.0.15", wantErr: ErrInvalidArgument(""), wantNext: "10.0.0.2"},
+		{name: "outside the pool", gateway: "10.0.1.1", wantErr: ErrInvalidArgument(""), wantNext: "10.0.0.2"},
+		{
+			name: "reserved address",
+			setup: func(t *testing.T, a *LocalAllocator, pool *net.IPNet) {
+				a.allocated[pool.String()].reserved = []OffsetRange{{First: 4, Last: 5}}
+			},
+			gateway: "10.0.0.4", wantErr: ErrConflict(""), wantNext: "10.0.0.2",
+		},
+		{
+			name: "allocated address",
+			setup: func(t *testing.T, a *LocalAllocator, pool *net.IPNet) {
+				if _, err := a.RequestAddress(pool, nil, net.ParseIP("10.0.0.5")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			gateway: "10.0.0.5", wantErr: ErrConflict(""), wantNext: "10.0.0.2",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := NewLocalAllocator(NewMemoryStore())
+			if err := a.AddPool(mustParsePool(t, "10.0.0.0/28")); err != nil {
+				t.Fatal(err)
+			}
+			pool, err := a.RequestPool(DefaultClass, 28, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.setup != nil {
+				test.setup(t, a, pool)
+			}
+
+			got, err := a.RequestGateway(pool, net.ParseIP(test.gateway))
+			if test.wantErr != nil {
+				if !sameErrorType(err, test.wantErr) {
+					t.Fatalf("got error %v, want a %T", err, test.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if got.String() != test.want {
+				t.Errorf("got gateway %s, want %s", got, test.want)
+			}
+
+			next, err := a.RequestAddress(pool, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next.String() != test.wantNext {
+				t.Errorf("next address is %s, want %s", next, test.wantNext)
+			}
+		})
+	}
+}
+
+func TestRequestGatewayReleasesOldAddress(t *testing.T) {
+	a := NewLocalAllocator(NewMemoryStore())
+	if err := a.AddPool(mustParsePool(t, "10.0.0.0/30")); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := a.RequestPool(DefaultClass, 30, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.RequestGateway(pool, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A /30 has two usable addresses, so the pool is only full again if the old gateway was released
+	if _, err := a.RequestGateway(pool, net.ParseIP("10.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := a.RequestAddress(pool, nil, nil); err != nil || ip.String() != "10.0.0.1" {
+		t.Fatalf("got %v, %v, want the old gateway 10.0.0.1", ip, err)
+	}
+	if _, err := a.RequestAddress(pool, nil, nil); !sameErrorType(err, ErrExhausted("")) {
+		t.Errorf("got error %v, want the pool exhausted", err)
+	}
+}
+
+// sameErrorType checks that err is of the same allocator error type as want.
+func sameErrorType(err, want error) bool {
+	return err != nil && reflect.TypeOf(err) == reflect.TypeOf(want)
+}
@@ -0,0 +1,200 @@
+package allocator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// maxCASRetries bounds how many times an update is retried when other hosts keep modifying the state first.
+const maxCASRetries = 16
+
+// GlobalAllocator is an allocator which keeps its state in a shared KVStore, so it can be used across a cluster.
+// Every operation reads the state, applies the change, and writes it back with a compare-and-swap,
+// retrying if another host updated the state in the meantime.
+type GlobalAllocator struct {
+	store   KVStore
+	key     string
+	lock    sync.Mutex
+	gateway GatewayPosition
+	policy  SelectionPolicy
+}
+
+// NewGlobalAllocator creates a GlobalAllocator which keeps its state under key in store.
+func NewGlobalAllocator(store KVStore, key string) *GlobalAllocator {
+	return &GlobalAllocator{store: store, key: key}
+}
+
+func (g *GlobalAllocator) addrSpace() string {
+	return "global"
+}
+
+// SetGatewayPosition sets which address is reserved for the gateway of pools which do not yet have one.
+func (g *GlobalAllocator) SetGatewayPosition(pos GatewayPosition) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.gateway = pos
+}
+
+// SetSelectionPolicy sets how free pools are chosen for requests which do not name a pool.
+func (g *GlobalAllocator) SetSelectionPolicy(policy SelectionPolicy) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.policy = policy
+}
+
+// read loads the shared state into a LocalAllocator which is not backed by a state directory.
+func (g *GlobalAllocator) read() (*LocalAllocator, uint64, error) {
+	data, index, err := g.store.Get(g.key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	g.lock.Lock()
+	a := &LocalAllocator{gateway: g.gateway, policy: g.policy}
+	g.lock.Unlock()
+	a.reset()
+
+	if data == nil {
+		return a, index, nil
+	}
+	st := &State{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, 0, fmt.Errorf("Failed to parse global state %s: %s", g.key, err)
+	}
+	if err := a.restoreNoLock(st); err != nil {
+		return nil, 0, err
+	}
+	return a, index, nil
+}
+
+// update applies fn to the shared state and writes it back, retrying if the state was changed concurrently.
+// If fn returns an error the state is not written.
+func (g *GlobalAllocator) update(fn func(a *LocalAllocator) error) error {
+	for i := 0; i < maxCASRetries; i++ {
+		a, index, err := g.read()
+		if err != nil {
+			return err
+		}
+		if err := fn(a); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(a.snapshotNoLock())
+		if err != nil {
+			return err
+		}
+		ok, err := g.store.CompareAndSwap(g.key, data, index)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return contentionf("Gave up updating global state %s after %d conflicting writes", g.key, maxCASRetries)
+}
+
+// AddPool adds a new subnet to be used in allocations.
+func (g *GlobalAllocator) AddPool(pool *net.IPNet) error {
+	return g.update(func(a *LocalAllocator) error {
+		return a.AddPool(pool)
+	})
+}
+
+// ReconcilePools makes the given pools the base pools of the shared state. See LocalAllocator.ReconcilePools.
+func (g *GlobalAllocator) ReconcilePools(pools []*net.IPNet) (*PoolDiff, error) {
+	var diff *PoolDiff
+	err := g.update(func(a *LocalAllocator) (err error) {
+		diff, err = a.ReconcilePools(pools)
+		return err
+	})
+	return diff, err
+}
+
+func (g *GlobalAllocator) RequestPool(class string, masklen int, v6 bool, pool *net.IPNet) (*net.IPNet, error) {
+	var res *net.IPNet
+	err := g.update(func(a *LocalAllocator) (err error) {
+		res, err = a.RequestPool(class, masklen, v6, pool)
+		return err
+	})
+	return res, err
+}
+
+// RequestStickyPool allocates a pool from the shared state, leasing it to key. See LocalAllocator.RequestStickyPool.
+func (g *GlobalAllocator) RequestStickyPool(key, class string, masklen int, v6 bool) (*net.IPNet, error) {
+	var res *net.IPNet
+	err := g.update(func(a *LocalAllocator) (err error) {
+		res, err = a.RequestStickyPool(key, class, masklen, v6)
+		return err
+	})
+	return res, err
+}
+
+func (g *GlobalAllocator) ReleasePool(pool *net.IPNet) error {
+	return g.update(func(a *LocalAllocator) error {
+		return a.ReleasePool(pool)
+	})
+}
+
+func (g *GlobalAllocator) RequestAddress(pool, subpool *net.IPNet, ip net.IP) (net.IP, error) {
+	var res net.IP
+	err := g.update(func(a *LocalAllocator) (err error) {
+		res, err = a.RequestAddress(pool, subpool, ip)
+		return err
+	})
+	return res, err
+}
+
+// RequestStickyAddress allocates an address from the shared state, leasing it to mac. See LocalAllocator.RequestStickyAddress.
+func (g *GlobalAllocator) RequestStickyAddress(pool, subpool *net.IPNet, mac string) (net.IP, error) {
+	var res net.IP
+	err := g.update(func(a *LocalAllocator) (err error) {
+		res, err = a.RequestStickyAddress(pool, subpool, mac)
+		return err
+	})
+	return res, err
+}
+
+func (g *GlobalAllocator) RequestGateway(pool *net.IPNet, ip net.IP) (net.IP, error) {
+	var res net.IP
+	err := g.update(func(a *LocalAllocator) (err error) {
+		res, err = a.RequestGateway(pool, ip)
+		return err
+	})
+	return res, err
+}
+
+func (g *GlobalAllocator) ReleaseAddress(pool *net.IPNet, ip net.IP) error {
+	return g.update(func(a *LocalAllocator) error {
+		return a.ReleaseAddress(pool, ip)
+	})
+}
+
+// RemovePool removes a base pool from the shared state. See LocalAllocator.RemovePool.
+func (g *GlobalAllocator) RemovePool(pool *net.IPNet) error {
+	return g.update(func(a *LocalAllocator) error {
+		return a.RemovePool(pool)
+	})
+}
+
+// Snapshot gives the current shared state.
+func (g *GlobalAllocator) Snapshot() (*State, error) {
+	a, _, err := g.read()
+	if err != nil {
+		return nil, err
+	}
+	return a.snapshotNoLock(), nil
+}
+
+// Usage gives what has been allocated from the shared state.
+func (g *GlobalAllocator) Usage() (*Usage, error) {
+	a, _, err := g.read()
+	if err != nil {
+		return nil, err
+	}
+	return a.usageNoLock(), nil
+}
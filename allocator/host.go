@@ -0,0 +1,97 @@
+package allocator
+
+import (
+	"fmt"
+	"net"
+)
+
+// SetAvoid sets a function giving networks which automatically chosen pools must not overlap, such as the host's routes.
+// It is called on each request, so changes such as a VPN connecting are taken into account. A nil function disables the check.
+func (a *LocalAllocator) SetAvoid(fn func() ([]*net.IPNet, error)) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.avoid = fn
+}
+
+// avoidNetworks gives the networks to avoid in the address family with the given length in bits.
+func (a *LocalAllocator) avoidNetworks(bits int) ([]*net.IPNet, error) {
+	a.lock.RLock()
+	fn := a.avoid
+	a.lock.RUnlock()
+
+	if fn == nil {
+		return nil, nil
+	}
+	networks, err := fn()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read networks to avoid: %s", err)
+	}
+
+	var res []*net.IPNet
+	for _, network := range networks {
+		network = normalizePool(network)
+		if network == nil {
+			continue
+		}
+		// A default route overlaps everything, so it can never be avoided
+		if masklen, b := network.Mask.Size(); b == bits && masklen > 0 {
+			res = append(res, network)
+		}
+	}
+	return res, nil
+}
+
+// requestAvoidingPoolNoLock allocates a pool of the requested size which overlaps none of the given networks.
+// Free pools are tried in the order of the selection policy.
+func (a *LocalAllocator) requestAvoidingPoolNoLock(c *poolClass, key, class string, masklen, bits int, avoid []*net.IPNet) (*net.IPNet, error) {
+	for _, free := range a.candidatesNoLock(c, masklen, bits) {
+		if pool := avoidingSubpool(free, masklen, avoid); pool != nil {
+			return a.requestSpecificPoolNoLock(pool, key)
+		}
+	}
+	return nil, exhaustedf("No pool availible to allocate a /%d subnet%s without overlapping host networks", masklen, inClass(class))
+}
+
+// avoidingSubpool finds the lowest subnet of pool with the given mask length which overlaps none of the given networks.
+// nil is returned if there is none.
+func avoidingSubpool(pool *net.IPNet, masklen int, avoid []*net.IPNet) *net.IPNet {
+	overlap := false
+	for _, network := range avoid {
+		if poolOverlap(pool, network) {
+			overlap = true
+			break
+		}
+	}
+
+	poollen, bits := pool.Mask.Size()
+	if !overlap {
+		return normalizePool(&net.IPNet{IP: pool.IP, Mask: net.CIDRMask(masklen, bits)})
+	}
+	if poollen >= masklen {
+		return nil
+	}
+
+	// Only the halves which overlap need searching further
+	left, right := splitPool(pool)
+	if res := avoidingSubpool(left, masklen, avoid); res != nil {
+		return res
+	}
+	return avoidingSubpool(right, masklen, avoid)
+}
+
+// interfaceNetworks gives the networks of the addresses assigned to the host's interfaces.
+func interfaceNetworks() ([]*net.IPNet, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*net.IPNet
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			res = append(res, ipnet)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,88 @@
+package allocator
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// HostNetworks gives the networks the host can reach directly or has routes to, from its interfaces and routing tables.
+func HostNetworks() ([]*net.IPNet, error) {
+	res, err := interfaceNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	routes, err := readRoutes("/proc/net/route", parseRoute)
+	if err != nil {
+		return nil, err
+	}
+	res = append(res, routes...)
+
+	routes, err = readRoutes("/proc/net/ipv6_route", parseRoute6)
+	if os.IsNotExist(err) {
+		// IPv6 is disabled
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(res, routes...), nil
+}
+
+// readRoutes parses each line of a routing table in procfs, skipping lines which are not routes.
+func readRoutes(path string, parse func([]string) *net.IPNet) ([]*net.IPNet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var res []*net.IPNet
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if route := parse(strings.Fields(scanner.Text())); route != nil {
+			res = append(res, route)
+		}
+	}
+	return res, scanner.Err()
+}
+
+// parseRoute parses a line of /proc/net/route, where the destination and mask are little-endian hex.
+func parseRoute(fields []string) *net.IPNet {
+	if len(fields) < 8 {
+		return nil
+	}
+	dst, err := hex.DecodeString(fields[1])
+	if err != nil || len(dst) != net.IPv4len {
+		return nil // The header line
+	}
+	mask, err := hex.DecodeString(fields[7])
+	if err != nil || len(mask) != net.IPv4len {
+		return nil
+	}
+	for i, j := 0, net.IPv4len-1; i < j; i, j = i+1, j-1 {
+		dst[i], dst[j] = dst[j], dst[i]
+		mask[i], mask[j] = mask[j], mask[i]
+	}
+	return &net.IPNet{IP: net.IP(dst), Mask: net.IPMask(mask)}
+}
+
+// parseRoute6 parses a line of /proc/net/ipv6_route, where the destination is hex and the prefix length a hex number.
+func parseRoute6(fields []string) *net.IPNet {
+	if len(fields) < 2 {
+		return nil
+	}
+	dst, err := hex.DecodeString(fields[0])
+	if err != nil || len(dst) != net.IPv6len {
+		return nil
+	}
+	masklen, err := strconv.ParseUint(fields[1], 16, 8)
+	if err != nil || masklen > 8*net.IPv6len {
+		return nil
+	}
+	return &net.IPNet{IP: net.IP(dst), Mask: net.CIDRMask(int(masklen), 8*net.IPv6len)}
+}
@@ -0,0 +1,63 @@
+package allocator
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const routeFixture = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	0100A8C0	0003	0	0	100	00000000	0	0	0
+eth0	0000A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+docker0	000011AC	00000000	0001	0	0	0	0000FFFF	0	0	0
+tun0	4000640A	00000000	0001	0	0	0	C0FFFFFF	0	0	0
+bad	nothex	00000000	0001	0	0	0	00FFFFFF	0	0	0
+`
+
+const route6Fixture = `fe800000000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0
+20010db8000100000000000000000000 30 00000000000000000000000000000000 00 00000000000000000000000000000000 00000400 00000001 00000000 00000001     eth0
+fd000000000000000000000000000001 80 00000000000000000000000000000000 00 00000000000000000000000000000000 00000000 00000002 00000000 80200001       lo
+00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003     eth0
+20010db8000000000000000000000000 81 00000000000000000000000000000000 00 00000000000000000000000000000000 00000400 00000001 00000000 00000001     bad
+`
+
+func TestReadRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		parse   func([]string) *net.IPNet
+		want    []string
+	}{
+		{
+			// Addresses and masks are little-endian, so 0000A8C0 is 192.168.0.0, and the header is skipped
+			name:    "ipv4",
+			fixture: routeFixture,
+			parse:   parseRoute,
+			want:    []string{"0.0.0.0/0", "192.168.0.0/24", "172.17.0.0/16", "10.100.0.64/26"},
+		},
+		{
+			// Prefix lengths are hex, so 40 is /64, and 81 is out of range
+			name:    "ipv6",
+			fixture: route6Fixture,
+			parse:   parseRoute6,
+			want:    []string{"fe80::/64", "2001:db8:1::/48", "fd00::1/128", "::/0"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "route")
+			if err := os.WriteFile(path, []byte(test.fixture), 0644); err != nil {
+				t.Fatal(err)
+			}
+			routes, err := readRoutes(path, test.parse)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := poolStrings(routes); !equalStrings(got, test.want) {
+				t.Errorf("got routes %v, want %v", got, test.want)
+			}
+		})
+	}
+}
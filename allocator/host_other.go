@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package allocator
+
+import "net"
+
+// HostNetworks gives the networks of the host's interfaces.
+// Routing tables are only read on Linux.
+func HostNetworks() ([]*net.IPNet, error) {
+	return interfaceNetworks()
+}
@@ -0,0 +1,173 @@
+package allocator
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// compactInterval is the least time between snapshots, during which changes are only recorded in the journal.
+const compactInterval = 10 * time.Second
+
+// Journal operations
+const (
+	opAddPool          = "add_pool"
+	opReconcile        = "reconcile"
+	opReconcileClasses = "reconcile_classes"
+	opExclude          = "exclude"
+	opRequestPool      = "request_pool"
+	opReleasePool      = "release_pool"
+	opRequestAddress   = "request_address"
+	opRequestGateway   = "request_gateway"
+	opReleaseAddress   = "release_address"
+)
+
+// JournalEntry records a single change to a LocalAllocator made after its last saved snapshot.
+// Entries record the outcome of each change, such as the pool chosen, so they replay exactly.
+type JournalEntry struct {
+	Seq  uint64 `json:"seq"`
+	Op   string `json:"op"`
+	Pool string `json:"pool,omitempty"`
+	// Class is the pool class reconciled, if not the default.
+	Class string `json:"class,omitempty"`
+	// Addr is the address allocated or released, or the gateway chosen for a newly allocated pool.
+	Addr string `json:"addr,omitempty"`
+	// Pools are the base pools given to a reconcile, or the excluded subnets.
+	Pools []string `json:"pools,omitempty"`
+	// Classes are the base pools of each class given to a reconcile of every class.
+	Classes map[string][]string `json:"classes,omitempty"`
+	// Reserved are the reserved offset ranges of a newly allocated pool.
+	Reserved []string `json:"reserved,omitempty"`
+	// Key is the sticky key a newly allocated pool was leased to, or the MAC address an allocated address was leased to, if any.
+	Key string `json:"key,omitempty"`
+}
+
+// recordNoLock appends a change to the journal, so it is durable before being acknowledged, and schedules a snapshot.
+// Changes are recorded before they are made in memory where possible. Otherwise the change is undone if it cannot be recorded,
+// so the allocator never holds changes which would be lost on restart.
+func (a *LocalAllocator) recordNoLock(e *JournalEntry) error {
+	if a.store != nil && !a.replaying {
+		e.Seq = a.seq + 1
+		if err := a.store.Append(e); err != nil {
+			atomic.AddUint64(&a.journalFailures, 1)
+			return fmt.Errorf("Failed to record %s in journal: %s", e.Op, err)
+		}
+		a.seq = e.Seq
+	}
+	a.signalUpdate()
+	return nil
+}
+
+// rollbackNoLock returns the allocator to st, a snapshot taken before a change which could not be recorded in the journal.
+// This is used for changes too involved to undo by hand, such as reconciling the base pools.
+func (a *LocalAllocator) rollbackNoLock(st *State) {
+	a.clearNoLock()
+	if err := a.restoreNoLock(st); err != nil {
+		// The snapshot was taken from this allocator, so it can only fail to restore if the allocator is broken
+		panic(fmt.Sprintf("Failed to roll back allocator state: %s", err))
+	}
+}
+
+// replay applies the journal entries recorded after the snapshot the allocator was restored from.
+func (a *LocalAllocator) replay(entries []*JournalEntry) error {
+	a.replaying = true
+	defer func() { a.replaying = false }()
+
+	for _, e := range entries {
+		if e.Seq <= a.seq {
+			// Already part of the snapshot, but the journal was not compacted
+			continue
+		}
+		if err := a.replayEntry(e); err != nil {
+			return fmt.Errorf("Failed to replay journal entry %d (%s): %s", e.Seq, e.Op, err)
+		}
+		a.seq = e.Seq
+	}
+	return nil
+}
+
+func (a *LocalAllocator) replayEntry(e *JournalEntry) error {
+	var pool *net.IPNet
+	if e.Pool != "" {
+		var err error
+		if pool, err = parsePool(e.Pool); err != nil {
+			return err
+		}
+	}
+	ip := net.ParseIP(e.Addr)
+
+	switch e.Op {
+	case opAddPool:
+		return a.AddPool(pool)
+	case opReconcile, opExclude:
+		var pools []*net.IPNet
+		for _, str := range e.Pools {
+			p, err := parsePool(str)
+			if err != nil {
+				return err
+			}
+			pools = append(pools, p)
+		}
+		var err error
+		if e.Op == opReconcile {
+			class := e.Class
+			if class == "" {
+				class = DefaultClass
+			}
+			a.lock.Lock()
+			_, err = a.reconcileClassNoLock(class, pools)
+			a.lock.Unlock()
+		} else {
+			_, err = a.SetExcluded(pools)
+		}
+		return err
+	case opReconcileClasses:
+		classes := make(map[string][]*net.IPNet)
+		for name, strs := range e.Classes {
+			classes[name] = nil
+			for _, str := range strs {
+				p, err := parsePool(str)
+				if err != nil {
+					return err
+				}
+				classes[name] = append(classes[name], p)
+			}
+		}
+		_, err := a.ReconcileClasses(classes)
+		return err
+	case opRequestPool:
+		var reserved []OffsetRange
+		for _, str := range e.Reserved {
+			r, err := ParseOffsetRange(str)
+			if err != nil {
+				return err
+			}
+			reserved = append(reserved, r)
+		}
+		if _, err := a.requestPool(e.Key, DefaultClass, 0, false, pool); err != nil {
+			return err
+		}
+
+		a.lock.Lock()
+		addrs := a.allocated[pool.String()]
+		addrs.reserved = reserved
+		if ip != nil {
+			addrs.gateway, _ = addrs.offset(ip)
+		}
+		a.lock.Unlock()
+		return nil
+	case opReleasePool:
+		return a.ReleasePool(pool)
+	case opRequestAddress:
+		_, err := a.requestAddress(pool, nil, ip, e.Key)
+		return err
+	case opRequestGateway:
+		_, err := a.RequestGateway(pool, ip)
+		return err
+	case opReleaseAddress:
+		return a.ReleaseAddress(pool, ip)
+	default:
+		return fmt.Errorf("Unknown operation")
+	}
+}
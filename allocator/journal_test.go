@@ -0,0 +1,221 @@
+package allocator
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// failStore is a MemoryStore whose journal appends fail while fail is set.
+type failStore struct {
+	*MemoryStore
+	fail bool
+}
+
+func (s *failStore) Append(e *JournalEntry) error {
+	if s.fail {
+		return errors.New("disk full")
+	}
+	return s.MemoryStore.Append(e)
+}
+
+func mustParsePool(t *testing.T, str string) *net.IPNet {
+	t.Helper()
+	_, pool, err := net.ParseCIDR(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// stateJSON gives the state of a as JSON, without the fields which change between snapshots of the same state.
+func stateJSON(t *testing.T, a *LocalAllocator) string {
+	t.Helper()
+	st, err := a.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Metadata = StateMetadata{}
+	st.JournalSeq = 0
+	data, err := json.Marshal(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRecordFailureLeavesStateUnchanged(t *testing.T) {
+	tests := []struct {
+		name string
+		op   func(a *LocalAllocator, pool *net.IPNet) error
+	}{
+		{"AddPool", func(a *LocalAllocator, pool *net.IPNet) error {
+			return a.AddPool(mustParsePool(t, "10.1.0.0/16"))
+		}},
+		{"RequestPool", func(a *LocalAllocator, pool *net.IPNet) error {
+			_, err := a.RequestPool(DefaultClass, 28, false, nil)
+			return err
+		}},
+		{"ReleasePool", func(a *LocalAllocator, pool *net.IPNet) error {
+			return a.ReleasePool(pool)
+		}},
+		{"RequestAddress", func(a *LocalAllocator, pool *net.IPNet) error {
+			_, err := a.RequestAddress(pool, nil, nil)
+			return err
+		}},
+		{"ReleaseAddress", func(a *LocalAllocator, pool *net.IPNet) error {
+			return a.ReleaseAddress(pool, net.ParseIP("10.0.0.2"))
+		}},
+		{"RequestGateway", func(a *LocalAllocator, pool *net.IPNet) error {
+			_, err := a.RequestGateway(pool, net.ParseIP("10.0.0.14"))
+			return err
+		}},
+		{"SetExcluded", func(a *LocalAllocator, pool *net.IPNet) error {
+			_, err := a.SetExcluded([]*net.IPNet{mustParsePool(t, "10.0.128.0/17")})
+			return err
+		}},
+		{"ReconcilePools", func(a *LocalAllocator, pool *net.IPNet) error {
+			_, err := a.ReconcilePools([]*net.IPNet{mustParsePool(t, "10.0.0.0/24")})
+			return err
+		}},
+		{"ReconcileClasses", func(a *LocalAllocator, pool *net.IPNet) error {
+			_, err := a.ReconcileClasses(map[string][]*net.IPNet{
+				DefaultClass: {mustParsePool(t, "10.0.0.0/17")},
+				"ci":         {mustParsePool(t, "10.0.128.0/17")},
+			})
+			return err
+		}},
+		{"RemovePool", func(a *LocalAllocator, pool *net.IPNet) error {
+			return a.RemovePool(mustParsePool(t, "10.0.0.0/16"))
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &failStore{MemoryStore: NewMemoryStore()}
+			a := NewLocalAllocator(store)
+			if err := a.AddPool(mustParsePool(t, "10.0.0.0/16")); err != nil {
+				t.Fatal(err)
+			}
+			pool, err := a.RequestPool(DefaultClass, 28, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.RequestAddress(pool, nil, net.ParseIP("10.0.0.2")); err != nil {
+				t.Fatal(err)
+			}
+
+			before := stateJSON(t, a)
+			store.fail = true
+			if err := test.op(a, pool); err == nil {
+				t.Fatal("expected an error when the journal cannot be written")
+			}
+			if after := stateJSON(t, a); after != before {
+				t.Errorf("state changed by a change which was not recorded\nbefore: %s\nafter:  %s", before, after)
+			}
+		})
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	store := NewMemoryStore()
+
+	// Without autosave nothing is ever saved, so the state can only come back by replaying the journal
+	a := &LocalAllocator{store: store}
+	a.reset()
+	if _, err := a.ReconcileClasses(map[string][]*net.IPNet{
+		DefaultClass: {mustParsePool(t, "10.0.0.0/16")},
+		"ci":         {mustParsePool(t, "10.1.0.0/16")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.SetExcluded([]*net.IPNet{mustParsePool(t, "10.0.0.0/24")}); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := a.RequestStickyPool("web", "ci", 26, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.RequestGateway(pool, nil); err != nil {
+		t.Fatal(err)
+	}
+	ip, err := a.RequestStickyAddress(pool, nil, "02:42:ac:11:00:02")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ReleaseAddress(pool, ip); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.RequestPool(DefaultClass, 28, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := LoadLocalAllocator(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := stateJSON(t, a), stateJSON(t, b); got != want {
+		t.Errorf("replayed state differs\nwant: %s\ngot:  %s", want, got)
+	}
+}
+
+func TestJournalTornTail(t *testing.T) {
+	tests := []struct {
+		name string
+		tail string
+	}{
+		{"partial entry", `{"seq":3,"op":"request_po`},
+		{"entry missing its newline", `{"seq":3,"op":"add_pool","pool":"10.2.0.0/16"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := NewFileStore(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			for _, e := range []*JournalEntry{
+				{Seq: 1, Op: opAddPool, Pool: "10.0.0.0/16"},
+				{Seq: 2, Op: opRequestPool, Pool: "10.0.0.0/28"},
+			} {
+				if err := store.Append(e); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			path := filepath.Join(dir, journalFileName)
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString(test.tail)
+			f.Close()
+
+			entries, err := store.Entries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 2 {
+				t.Fatalf("got %d entries, want the 2 complete ones", len(entries))
+			}
+
+			// The torn line is removed, so the next entry is read back on its own line
+			if err := store.Append(&JournalEntry{Seq: 3, Op: opReleasePool, Pool: "10.0.0.0/28"}); err != nil {
+				t.Fatal(err)
+			}
+			entries, err = store.Entries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 3 || entries[2].Op != opReleasePool {
+				t.Fatalf("entry appended after a torn line was lost: %+v", entries)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package allocator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// KVStore is a key-value store with compare-and-swap semantics, in the style of etcd or Consul.
+type KVStore interface {
+	// Get gives the value of key and the index at which it was last modified.
+	// If key is not set, the value is nil and the index is 0.
+	Get(key string) ([]byte, uint64, error)
+
+	// CompareAndSwap sets key to value only if it was last modified at index, or is unset if index is 0.
+	// It returns false, without an error, if the key has been modified since.
+	CompareAndSwap(key string, value []byte, index uint64) (bool, error)
+}
+
+// ParseKVStore opens the store described by a URL, giving the store and the key under which to keep state.
+// Supported URLs are consul://host:port/prefix and memory:///prefix, the latter being useful only for testing.
+func ParseKVStore(rawurl string) (KVStore, string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, "", err
+	}
+
+	prefix := strings.Trim(u.Path, "/")
+	if prefix == "" {
+		prefix = "mini-ipam"
+	}
+	key := prefix + "/state"
+
+	switch u.Scheme {
+	case "consul":
+		return &ConsulKV{Address: "http://" + u.Host}, key, nil
+	case "memory":
+		return NewMemoryKV(), key, nil
+	default:
+		return nil, "", fmt.Errorf("Unsupported store type: %s", u.Scheme)
+	}
+}
+
+// MemoryKV is a KVStore held in process memory.
+// It stands in for an external store when testing, or when a cluster is a single host.
+type MemoryKV struct {
+	lock   sync.Mutex
+	values map[string][]byte
+	index  map[string]uint64
+	last   uint64
+}
+
+// NewMemoryKV creates an empty MemoryKV.
+func NewMemoryKV() *MemoryKV {
+	return &MemoryKV{values: make(map[string][]byte), index: make(map[string]uint64)}
+}
+
+func (m *MemoryKV) Get(key string) ([]byte, uint64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.values[key], m.index[key], nil
+}
+
+func (m *MemoryKV) CompareAndSwap(key string, value []byte, index uint64) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.index[key] != index {
+		return false, nil
+	}
+
+	m.last++
+	m.values[key] = append([]byte(nil), value...)
+	m.index[key] = m.last
+	return true, nil
+}
+
+// ConsulKV is a KVStore backed by the Consul HTTP key-value API.
+type ConsulKV struct {
+	// Address is the base URL of the Consul agent, such as http://127.0.0.1:8500
+	Address string
+	// Client is used to make requests, or http.DefaultClient if nil
+	Client *http.Client
+}
+
+func (c *ConsulKV) client() *http.Client {
+	if c.Client == nil {
+		return http.DefaultClient
+	}
+	return c.Client
+}
+
+func (c *ConsulKV) Get(key string) ([]byte, uint64, error) {
+	resp, err := c.client().Get(c.Address + "/v1/kv/" + key)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, 0, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("Consul returned %s reading %s", resp.Status, key)
+	}
+
+	var entries []struct {
+		ModifyIndex uint64
+		Value       []byte // Consul sends the value base64 encoded, which encoding/json decodes
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+	if len(entries) == 0 {
+		return nil, 0, nil
+	}
+	return entries[0].Value, entries[0].ModifyIndex, nil
+}
+
+func (c *ConsulKV) CompareAndSwap(key string, value []byte, index uint64) (bool, error) {
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/v1/kv/%s?cas=%d", c.Address, key, index), bytes.NewReader(value))
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Consul returned %s writing %s: %s", resp.Status, key, strings.TrimSpace(string(body)))
+	}
+	return strings.TrimSpace(string(body)) == "true", nil
+}
@@ -0,0 +1,118 @@
+package allocator
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestMemoryKVCompareAndSwap(t *testing.T) {
+	kv := NewMemoryKV()
+
+	steps := []struct {
+		name  string
+		value string
+		index func(current uint64) uint64
+		want  bool
+	}{
+		{"create when unset", "a", func(uint64) uint64 { return 0 }, true},
+		{"create when already set", "b", func(uint64) uint64 { return 0 }, false},
+		{"update at the current index", "c", func(current uint64) uint64 { return current }, true},
+		{"update at a stale index", "d", func(current uint64) uint64 { return current - 1 }, false},
+		{"update at a future index", "e", func(current uint64) uint64 { return current + 1 }, false},
+	}
+
+	want := ""
+	for _, step := range steps {
+		_, index, err := kv.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := kv.CompareAndSwap("key", []byte(step.value), step.index(index))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != step.want {
+			t.Errorf("%s: swapped = %t, want %t", step.name, ok, step.want)
+		}
+		if ok {
+			want = step.value
+		}
+
+		value, _, _ := kv.Get("key")
+		if string(value) != want {
+			t.Errorf("%s: value = %q, want %q", step.name, value, want)
+		}
+	}
+}
+
+// racingKV is a KVStore which lets another host write the key between every read and the following compare-and-swap.
+type racingKV struct {
+	*MemoryKV
+}
+
+func (r *racingKV) CompareAndSwap(key string, value []byte, index uint64) (bool, error) {
+	current, currentIndex, _ := r.MemoryKV.Get(key)
+	r.MemoryKV.CompareAndSwap(key, current, currentIndex)
+	return r.MemoryKV.CompareAndSwap(key, value, index)
+}
+
+func TestGlobalAllocatorGivesUpUnderContention(t *testing.T) {
+	kv := NewMemoryKV()
+	if _, err := NewGlobalAllocator(kv, "state").ReconcilePools([]*net.IPNet{mustParsePool(t, "10.0.0.0/24")}); err != nil {
+		t.Fatal(err)
+	}
+
+	g := NewGlobalAllocator(&racingKV{kv}, "state")
+	_, err := g.RequestPool(DefaultClass, 28, false, nil)
+	if _, ok := err.(ErrContention); !ok {
+		t.Fatalf("got error %v, want ErrContention", err)
+	}
+}
+
+func TestGlobalAllocatorsShareState(t *testing.T) {
+	kv := NewMemoryKV()
+	hosts := []*GlobalAllocator{NewGlobalAllocator(kv, "state"), NewGlobalAllocator(kv, "state"), NewGlobalAllocator(kv, "state")}
+	if _, err := hosts[0].ReconcilePools([]*net.IPNet{mustParsePool(t, "10.0.0.0/24")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every /28 is requested at once from different hosts, so many of the writes conflict and are retried
+	var wg sync.WaitGroup
+	pools := make(chan string, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(g *GlobalAllocator) {
+			defer wg.Done()
+			for {
+				pool, err := g.RequestPool(DefaultClass, 28, false, nil)
+				if _, ok := err.(ErrContention); ok {
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				pools <- pool.String()
+				return
+			}
+		}(hosts[i%len(hosts)])
+	}
+	wg.Wait()
+	close(pools)
+
+	seen := make(map[string]bool)
+	for pool := range pools {
+		if seen[pool] {
+			t.Errorf("pool %s was given out twice", pool)
+		}
+		seen[pool] = true
+	}
+	if len(seen) != 16 {
+		t.Errorf("got %d distinct pools, want 16", len(seen))
+	}
+
+	if _, err := hosts[1].RequestPool(DefaultClass, 28, false, nil); err == nil {
+		t.Error("expected the shared pools to be exhausted")
+	}
+}
@@ -0,0 +1,120 @@
+package allocator
+
+import (
+	"net"
+)
+
+// RequestStickyPool allocates a pool as RequestPool does when no pool is named, leasing it to key.
+// If the pool last leased to key in the same address family is free, has the requested size, and is in the requested class,
+// that pool is allocated again. Leases are kept after their pools are released, so a network recreated with the same key
+// gets the same subnet back as long as nothing else has taken it in the meantime.
+func (a *LocalAllocator) RequestStickyPool(key, class string, masklen int, v6 bool) (*net.IPNet, error) {
+	if key == "" {
+		return nil, invalidf("Sticky key must not be empty")
+	}
+	return a.requestPool(key, class, masklen, v6, nil)
+}
+
+// leasedPoolNoLock gives the pool of the given address family leased to key, or nil if there is none.
+func (a *LocalAllocator) leasedPoolNoLock(key string, bits int) *net.IPNet {
+	if key == "" {
+		return nil
+	}
+	for _, pool := range a.leases[key] {
+		if _, poolbits := pool.Mask.Size(); poolbits == bits {
+			return pool
+		}
+	}
+	return nil
+}
+
+// leasedPoolsNoLock gives the pools of the given address family leased to keys other than key.
+func (a *LocalAllocator) leasedPoolsNoLock(key string, bits int) []*net.IPNet {
+	var res []*net.IPNet
+	for k, pools := range a.leases {
+		if k == key {
+			continue
+		}
+		for _, pool := range pools {
+			if _, poolbits := pool.Mask.Size(); poolbits == bits {
+				res = append(res, pool)
+			}
+		}
+	}
+	return res
+}
+
+// canLeaseNoLock checks if a leased pool can be allocated again for a request of the given size from class c.
+func (a *LocalAllocator) canLeaseNoLock(c *poolClass, leased *net.IPNet, masklen int, avoid []*net.IPNet) bool {
+	if leasedlen, _ := leased.Mask.Size(); leasedlen != masklen {
+		return false
+	}
+	for _, network := range avoid {
+		if poolOverlap(leased, network) {
+			return false
+		}
+	}
+	_, bits := leased.Mask.Size()
+	for _, free := range c.freeLists(bits)[:masklen+1] {
+		for _, pool := range free {
+			if poolContains(pool, leased) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// leaseNoLock leases pool to key, replacing the lease key held in the same address family.
+// Any lease another key held on an overlapping pool is dropped, so each subnet is remembered for the last key given it.
+func (a *LocalAllocator) leaseNoLock(key string, pool *net.IPNet) {
+	_, bits := pool.Mask.Size()
+	for k, pools := range a.leases {
+		var kept []*net.IPNet
+		for _, p := range pools {
+			_, pbits := p.Mask.Size()
+			if !poolOverlap(p, pool) && (k != key || pbits != bits) {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) == 0 {
+			delete(a.leases, k)
+		} else {
+			a.leases[k] = kept
+		}
+	}
+	a.leases[key] = append(a.leases[key], pool)
+}
+
+// RequestStickyAddress allocates an address from a previously allocated pool, as RequestAddress does when no address is
+// named, leasing it to the MAC address mac. If the address last leased to mac in the pool is free, and within subpool if it
+// is non-nil, that address is allocated again. Leases are kept after their addresses are released, until the pool is released.
+func (a *LocalAllocator) RequestStickyAddress(pool, subpool *net.IPNet, mac string) (net.IP, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, invalidf("Invalid MAC address: %s", mac)
+	}
+	return a.requestAddress(pool, subpool, nil, hw.String())
+}
+
+// leasedOffset gives the offset leased to mac if it is free to assign, in [lo, hi], and not skipped.
+func (b *addrBitmap) leasedOffset(mac string, lo, hi uint64, skip func(uint64) bool) (uint64, bool) {
+	off, found := b.leases[mac]
+	if !found || off < lo || off > hi || skip(off) || b.isSet(off) {
+		return 0, false
+	}
+	return off, true
+}
+
+// lease leases the address at off to mac, dropping the lease any other MAC address held on it.
+func (b *addrBitmap) lease(mac string, off uint64) {
+	if b.leases == nil {
+		b.leases = make(map[string]uint64)
+	}
+	for other, leased := range b.leases {
+		if leased == off {
+			delete(b.leases, other)
+		}
+	}
+	b.leases[mac] = off
+}
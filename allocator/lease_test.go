@@ -0,0 +1,175 @@
+package allocator
+
+import (
+	"net"
+	"testing"
+)
+
+func TestStickyPoolKeptFromOtherRequests(t *testing.T) {
+	for _, policy := range []SelectionPolicy{SelectBestFit, SelectLowestAddress, SelectKeepLargeBlocks} {
+		t.Run(policy.String(), func(t *testing.T) {
+			a := NewLocalAllocator(NewMemoryStore())
+			a.SetSelectionPolicy(policy)
+			if err := a.AddPool(mustParsePool(t, "10.0.0.0/23")); err != nil {
+				t.Fatal(err)
+			}
+
+			sticky, err := a.RequestStickyPool("net1", DefaultClass, 24, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := a.ReleasePool(sticky); err != nil {
+				t.Fatal(err)
+			}
+
+			// The released subnet is the lowest and best fitting free space, but it is still leased
+			other, err := a.RequestPool(DefaultClass, 24, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if other.String() == sticky.String() {
+				t.Errorf("non-sticky request took %s, which is leased to another key", other)
+			}
+			again, err := a.RequestStickyPool("net1", DefaultClass, 24, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again.String() != sticky.String() {
+				t.Errorf("sticky request got %s, want its leased subnet %s", again, sticky)
+			}
+		})
+	}
+}
+
+func TestStickyPoolUsedWhenNothingElseFits(t *testing.T) {
+	a := NewLocalAllocator(NewMemoryStore())
+	if err := a.AddPool(mustParsePool(t, "10.0.0.0/24")); err != nil {
+		t.Fatal(err)
+	}
+	sticky, err := a.RequestStickyPool("net1", DefaultClass, 24, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ReleasePool(sticky); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := a.RequestPool(DefaultClass, 24, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.String() != sticky.String() {
+		t.Errorf("non-sticky request got %s, want the only free subnet %s", other, sticky)
+	}
+}
+
+func TestStickyAddress(t *testing.T) {
+	const (
+		macA = "02:42:ac:10:00:0a"
+		macB = "02:42:ac:10:00:0b"
+	)
+	tests := []struct {
+		name string
+		// run requests and releases addresses from pool, and gives the address macA should get back last
+		run  func(t *testing.T, a *LocalAllocator, pool *net.IPNet) string
+		want string
+	}{
+		{
+			name: "released",
+			run: func(t *testing.T, a *LocalAllocator, pool *net.IPNet) string {
+				requestSticky(t, a, pool, nil, macA)
+				requestSticky(t, a, pool, nil, macB)
+				release(t, a, pool, "10.0.0.2")
+				release(t, a, pool, "10.0.0.3")
+				requestSticky(t, a, pool, nil, macB)
+				return requestSticky(t, a, pool, nil, macA)
+			},
+			want: "10.0.0.2",
+		},
+		{
+			name: "taken explicitly",
+			run: func(t *testing.T, a *LocalAllocator, pool *net.IPNet) string {
+				requestSticky(t, a, pool, nil, macA)
+				release(t, a, pool, "10.0.0.2")
+				if _, err := a.RequestAddress(pool, nil, net.ParseIP("10.0.0.2")); err != nil {
+					t.Fatal(err)
+				}
+				return requestSticky(t, a, pool, nil, macA)
+			},
+			want: "10.0.0.3",
+		},
+		{
+			name: "leased to another MAC",
+			run: func(t *testing.T, a *LocalAllocator, pool *net.IPNet) string {
+				if _, err := a.RequestAddress(pool, nil, nil); err != nil {
+					t.Fatal(err)
+				}
+				requestSticky(t, a, pool, nil, macA)
+				release(t, a, pool, "10.0.0.3")
+				requestSticky(t, a, pool, nil, macB)
+				release(t, a, pool, "10.0.0.3")
+				release(t, a, pool, "10.0.0.2")
+				return requestSticky(t, a, pool, nil, macA)
+			},
+			want: "10.0.0.2",
+		},
+		{
+			name: "outside the subpool",
+			run: func(t *testing.T, a *LocalAllocator, pool *net.IPNet) string {
+				requestSticky(t, a, pool, nil, macA)
+				release(t, a, pool, "10.0.0.2")
+				return requestSticky(t, a, pool, mustParsePool(t, "10.0.0.8/29"), macA)
+			},
+			want: "10.0.0.8",
+		},
+		{
+			name: "pool released",
+			run: func(t *testing.T, a *LocalAllocator, pool *net.IPNet) string {
+				if _, err := a.RequestAddress(pool, nil, nil); err != nil {
+					t.Fatal(err)
+				}
+				requestSticky(t, a, pool, nil, macA)
+				if err := a.ReleasePool(pool); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := a.RequestPool(DefaultClass, 0, false, pool); err != nil {
+					t.Fatal(err)
+				}
+				return requestSticky(t, a, pool, nil, macA)
+			},
+			want: "10.0.0.2",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := NewLocalAllocator(NewMemoryStore())
+			if err := a.AddPool(mustParsePool(t, "10.0.0.0/24")); err != nil {
+				t.Fatal(err)
+			}
+			pool, err := a.RequestPool(DefaultClass, 28, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := test.run(t, a, pool); got != test.want {
+				t.Errorf("got address %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func requestSticky(t *testing.T, a *LocalAllocator, pool, subpool *net.IPNet, mac string) string {
+	t.Helper()
+	ip, err := a.RequestStickyAddress(pool, subpool, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ip.String()
+}
+
+func release(t *testing.T, a *LocalAllocator, pool *net.IPNet, ip string) {
+	t.Helper()
+	if err := a.ReleaseAddress(pool, net.ParseIP(ip)); err != nil {
+		t.Fatal(err)
+	}
+}
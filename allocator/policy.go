@@ -0,0 +1,144 @@
+package allocator
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+)
+
+// SelectionPolicy chooses which free pool a subnet is carved from when the request does not name one.
+type SelectionPolicy int
+
+const (
+	// SelectBestFit takes the smallest free pool which is large enough, the lowest addressed one among equals.
+	SelectBestFit SelectionPolicy = iota
+	// SelectLowestAddress takes the lowest addressed free subnet of the requested size, keeping allocations together.
+	SelectLowestAddress
+	// SelectKeepLargeBlocks takes the smallest free pool which is large enough, from the part of the address space
+	// with the least free space around it, so regions which are mostly free can merge back into large blocks.
+	SelectKeepLargeBlocks
+)
+
+// ParseSelectionPolicy parses "best-fit", "lowest-address", or "keep-large-blocks" into a SelectionPolicy.
+func ParseSelectionPolicy(str string) (SelectionPolicy, error) {
+	switch str {
+	case "best-fit":
+		return SelectBestFit, nil
+	case "lowest-address":
+		return SelectLowestAddress, nil
+	case "keep-large-blocks":
+		return SelectKeepLargeBlocks, nil
+	default:
+		return SelectBestFit, fmt.Errorf("Pool selection must be \"best-fit\", \"lowest-address\", or \"keep-large-blocks\": %s", str)
+	}
+}
+
+func (p SelectionPolicy) String() string {
+	switch p {
+	case SelectLowestAddress:
+		return "lowest-address"
+	case SelectKeepLargeBlocks:
+		return "keep-large-blocks"
+	default:
+		return "best-fit"
+	}
+}
+
+// SetSelectionPolicy sets how free pools are chosen for requests which do not name a pool.
+func (a *LocalAllocator) SetSelectionPolicy(policy SelectionPolicy) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.policy = policy
+}
+
+// candidatesNoLock gives the free pools of a class large enough for a subnet with the given mask length, most preferred first.
+func (a *LocalAllocator) candidatesNoLock(c *poolClass, masklen, bits int) []*net.IPNet {
+	pools := c.freeLists(bits)
+
+	var res []*net.IPNet
+	for i := masklen; i >= 0; i-- {
+		res = append(res, pools[i]...)
+	}
+
+	lowest := func(i, j int) bool {
+		return bytes.Compare(res[i].IP, res[j].IP) < 0
+	}
+	smallest := func(i, j int) (bool, bool) {
+		mi, _ := res[i].Mask.Size()
+		mj, _ := res[j].Mask.Size()
+		return mi > mj, mi == mj
+	}
+
+	switch a.policy {
+	case SelectLowestAddress:
+		// Free pools never overlap, so this is also the order of their lowest subnets
+		sort.Slice(res, lowest)
+	case SelectKeepLargeBlocks:
+		free := freeAround(pools, bits)
+		sort.Slice(res, func(i, j int) bool {
+			if less, equal := smallest(i, j); !equal {
+				return less
+			}
+			// Prefer the pool with the least free space around it, looking out from its buddy
+			mi, _ := res[i].Mask.Size()
+			for k := mi - 1; k >= 0; k-- {
+				fi, fj := free[ancestorKey(res[i], k)], free[ancestorKey(res[j], k)]
+				if fi != fj {
+					return fi < fj
+				}
+			}
+			return lowest(i, j)
+		})
+	default:
+		sort.Slice(res, func(i, j int) bool {
+			if less, equal := smallest(i, j); !equal {
+				return less
+			}
+			return lowest(i, j)
+		})
+	}
+	return res
+}
+
+// freeAround totals the free addresses within every block enclosing a free pool, keyed by ancestorKey.
+func freeAround(pools [][]*net.IPNet, bits int) map[string]float64 {
+	free := make(map[string]float64)
+	for masklen, s := range pools {
+		size := math.Ldexp(1, bits-masklen)
+		for _, pool := range s {
+			for k := masklen - 1; k >= 0; k-- {
+				free[ancestorKey(pool, k)] += size
+			}
+		}
+	}
+	return free
+}
+
+// ancestorKey names the block with the given mask length which contains pool.
+func ancestorKey(pool *net.IPNet, masklen int) string {
+	mask := net.CIDRMask(masklen, 8*len(pool.IP))
+	return (&net.IPNet{IP: pool.IP.Mask(mask), Mask: mask}).String()
+}
+
+// Fragmentation gives the fraction of the free IPv4 or IPv6 addresses of a pool class which cannot be used for a subnet
+// with the given mask length, because they are in free pools smaller than it. It is 0 when there are no free addresses.
+// A high score means requests may fail even though plenty of addresses are free.
+func (s *Stats) Fragmentation(class string, masklen int, v6 bool) float64 {
+	var total, unusable float64
+	for _, c := range s.Free {
+		if c.Class != class || c.V6 != v6 {
+			continue
+		}
+		total += c.Addresses
+		if c.MaskLength > masklen {
+			unusable += c.Addresses
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return unusable / total
+}
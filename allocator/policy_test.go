@@ -0,0 +1,75 @@
+package allocator
+
+import (
+	"math"
+	"net"
+	"testing"
+)
+
+// fragmentedAllocator gives an allocator whose default class has only the free pools 10.0.0.128/25, 10.0.1.0/26, 10.0.1.128/25, and 10.0.2.0/26.
+// The class ci is left whole as 10.1.0.0/24. The free /26 in 10.0.1.0/24 has more free space around it than the one in 10.0.2.0/24.
+func fragmentedAllocator(t *testing.T) *LocalAllocator {
+	t.Helper()
+	a := NewLocalAllocator(NewMemoryStore())
+	if _, err := a.ReconcileClasses(map[string][]*net.IPNet{
+		DefaultClass: {mustParsePool(t, "10.0.0.0/22")},
+		"ci":         {mustParsePool(t, "10.1.0.0/24")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, pool := range []string{"10.0.0.0/25", "10.0.1.64/26", "10.0.2.64/26", "10.0.2.128/25", "10.0.3.0/24"} {
+		if _, err := a.RequestPool(DefaultClass, 0, false, mustParsePool(t, pool)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a
+}
+
+func TestSelectionPolicy(t *testing.T) {
+	tests := []struct {
+		policy SelectionPolicy
+		want   string
+	}{
+		{SelectBestFit, "10.0.1.0/26"},
+		{SelectLowestAddress, "10.0.0.128/26"},
+		{SelectKeepLargeBlocks, "10.0.2.0/26"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy.String(), func(t *testing.T) {
+			a := fragmentedAllocator(t)
+			a.SetSelectionPolicy(test.policy)
+			pool, err := a.RequestPool(DefaultClass, 26, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pool.String() != test.want {
+				t.Errorf("got pool %s, want %s", pool, test.want)
+			}
+		})
+	}
+}
+
+func TestFragmentation(t *testing.T) {
+	stats := fragmentedAllocator(t).Stats()
+
+	tests := []struct {
+		class   string
+		masklen int
+		v6      bool
+		want    float64
+	}{
+		{DefaultClass, 26, false, 0},
+		{DefaultClass, 25, false, 128.0 / 384},
+		{DefaultClass, 24, false, 1},
+		{"ci", 24, false, 0},
+		{"ci", 23, false, 1},
+		{DefaultClass, 64, true, 0},
+		{"none", 24, false, 0},
+	}
+	for _, test := range tests {
+		if got := stats.Fragmentation(test.class, test.masklen, test.v6); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("fragmentation of class %s for /%d (v6 %t) is %f, want %f", test.class, test.masklen, test.v6, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,479 @@
+package allocator
+
+import (
+	"net"
+	"sort"
+)
+
+// PoolDiff describes the changes made to an allocator when reconciling it with a set of base pools.
+type PoolDiff struct {
+	// Added are ranges of the base pools which the allocator was not tracking.
+	Added []*net.IPNet
+	// Retired are free ranges which are no longer within any base pool.
+	Retired []*net.IPNet
+	// Orphaned are allocated pools which are not within any base pool of any class.
+	// They are kept until released, at which point they are retired.
+	Orphaned []*net.IPNet
+}
+
+// ReconcilePools makes the given pools the base pools of the default class.
+// Ranges of the new pools which are not yet tracked are added as free pools, and free ranges outside of them are dropped.
+// Allocations, including any outside of the new pools, are left untouched.
+// The pools must not overlap the base pools of any other class.
+func (a *LocalAllocator) ReconcilePools(pools []*net.IPNet) (*PoolDiff, error) {
+	base, err := basePools(pools)
+	if err != nil {
+		return nil, err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.reconcileClassNoLock(DefaultClass, base)
+}
+
+// ReconcileClasses makes the given pools the base pools of each named class, like ReconcilePools does for the default class.
+// Classes which are not given are removed, except for the default class, which is left as it is.
+// Since all of the classes change together, ranges may move from one class to another.
+// Orphaned pools are outside of every class, so they are only reported in the diff of the default class.
+func (a *LocalAllocator) ReconcileClasses(classes map[string][]*net.IPNet) (map[string]*PoolDiff, error) {
+	bases := make(map[string][]*net.IPNet)
+	for name, pools := range classes {
+		if !ValidClassName(name) {
+			return nil, invalidf("Invalid pool class name: %q", name)
+		}
+		base, err := basePools(pools)
+		if err != nil {
+			return nil, err
+		}
+		bases[name] = base
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, found := bases[DefaultClass]; !found {
+		bases[DefaultClass] = a.classes[DefaultClass].base
+	}
+	var names []string
+	for name := range bases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		for _, other := range names[i+1:] {
+			if err := checkOverlap(bases[name], other, bases[other]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, name := range a.classNamesNoLock() {
+		if _, found := bases[name]; !found {
+			bases[name] = nil
+			names = append(names, name)
+		}
+	}
+
+	// Ranges moving between classes are dropped by the first pass, and only added to their new class by the second
+	prev := a.snapshotNoLock()
+	diffs := make(map[string]*PoolDiff)
+	for _, name := range names {
+		diffs[name] = a.reconcileNoLock(a.classOrNewNoLock(name), bases[name])
+	}
+	for _, name := range names {
+		diff := a.reconcileNoLock(a.classes[name], bases[name])
+		diffs[name].Added = append(diffs[name].Added, diff.Added...)
+		diffs[name].Retired = append(diffs[name].Retired, diff.Retired...)
+		// The first pass sees pools moving to later classes as orphaned, so only the final orphans are kept, once
+		diffs[name].Orphaned = nil
+		if name == DefaultClass {
+			diffs[name].Orphaned = diff.Orphaned
+		}
+		if len(bases[name]) == 0 && name != DefaultClass {
+			delete(a.classes, name)
+		}
+	}
+
+	// The default class is always recorded, since leaving it out would mean keeping its pools
+	e := &JournalEntry{Op: opReconcileClasses, Classes: map[string][]string{DefaultClass: nil}}
+	for _, name := range names {
+		for _, pool := range bases[name] {
+			e.Classes[name] = append(e.Classes[name], pool.String())
+		}
+	}
+	if err := a.recordNoLock(e); err != nil {
+		a.rollbackNoLock(prev)
+		return nil, err
+	}
+	return diffs, nil
+}
+
+// basePools normalizes pools to be used as base pools.
+func basePools(pools []*net.IPNet) ([]*net.IPNet, error) {
+	var base []*net.IPNet
+	for _, pool := range pools {
+		norm := normalizePool(pool)
+		if norm == nil {
+			return nil, invalidf("Only IPv4 and IPv6 subnets can be added")
+		}
+		if masklen, bits := norm.Mask.Size(); masklen >= bits {
+			return nil, invalidf("Pool must contain more than one address: %s", pool.String())
+		}
+		base = append(base, norm)
+	}
+	return base, nil
+}
+
+// checkOverlap returns an error if any of the pools overlap a pool of the named class.
+func checkOverlap(pools []*net.IPNet, class string, others []*net.IPNet) error {
+	for _, pool := range pools {
+		for _, other := range others {
+			if poolOverlap(pool, other) {
+				return conflictf("Pool %s overlaps pool %s of class %s", pool.String(), other.String(), class)
+			}
+		}
+	}
+	return nil
+}
+
+// checkAddOverlapNoLock returns an error if a pool being added overlaps a base, free, or allocated pool of any class,
+// since the same addresses could then be handed out twice.
+func (a *LocalAllocator) checkAddOverlapNoLock(pool *net.IPNet) error {
+	pools := []*net.IPNet{pool}
+	for _, name := range a.classNamesNoLock() {
+		c := a.classes[name]
+		if err := checkOverlap(pools, name, c.base); err != nil {
+			return err
+		}
+		if err := checkOverlap(pools, name, c.freePools()); err != nil {
+			return err
+		}
+	}
+	for _, allocated := range a.allocatedPoolsNoLock() {
+		if poolOverlap(pool, allocated) {
+			return conflictf("Pool %s overlaps allocated pool %s", pool.String(), allocated.String())
+		}
+	}
+	return nil
+}
+
+// RemovePool removes a pool previously added to the allocator, from whichever class it was added to.
+// Its free ranges are dropped, and pools allocated from it are kept until they are released.
+func (a *LocalAllocator) RemovePool(pool *net.IPNet) error {
+	norm := normalizePool(pool)
+	if norm == nil {
+		return invalidf("Only IPv4 and IPv6 subnets can be removed")
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, name := range a.classNamesNoLock() {
+		var base []*net.IPNet
+		for _, b := range a.classes[name].base {
+			if b.String() != norm.String() {
+				base = append(base, b)
+			}
+		}
+		if len(base) < len(a.classes[name].base) {
+			_, err := a.reconcileClassNoLock(name, base)
+			return err
+		}
+	}
+	return notFoundf("Pool was never added: %s", pool.String())
+}
+
+// reconcileClassNoLock makes the given pools the base pools of the named class, creating or removing the class as needed,
+// and records the change.
+func (a *LocalAllocator) reconcileClassNoLock(class string, base []*net.IPNet) (*PoolDiff, error) {
+	for name, c := range a.classes {
+		if name != class {
+			if err := checkOverlap(base, name, c.base); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	prev := a.snapshotNoLock()
+	diff := a.reconcileNoLock(a.classOrNewNoLock(class), base)
+	if len(base) == 0 && class != DefaultClass {
+		delete(a.classes, class)
+	}
+
+	e := &JournalEntry{Op: opReconcile}
+	if class != DefaultClass {
+		e.Class = class
+	}
+	for _, pool := range base {
+		e.Pools = append(e.Pools, pool.String())
+	}
+	if err := a.recordNoLock(e); err != nil {
+		a.rollbackNoLock(prev)
+		return nil, err
+	}
+	return diff, nil
+}
+
+// reconcileNoLock rebuilds the free pools of a class from the parts of the given base pools which are neither allocated nor excluded.
+func (a *LocalAllocator) reconcileNoLock(c *poolClass, base []*net.IPNet) *PoolDiff {
+	diff := &PoolDiff{}
+
+	// Rebuild the free lists from only the parts of the free pools within the new base pools, less the excluded subnets
+	free := c.freePools()
+	c.pools = make([][]*net.IPNet, len(c.pools))
+	c.pools6 = make([][]*net.IPNet, len(c.pools6))
+	for _, pool := range free {
+		keep, drop := clipPool(pool, base)
+		for _, p := range keep {
+			_, allowed := clipPool(p, a.excluded)
+			for _, q := range allowed {
+				a.addPoolNoLock(c, q)
+			}
+		}
+		diff.Retired = append(diff.Retired, drop...)
+	}
+	c.base = base
+
+	// Allocated pools are orphaned once they are outside the base pools of every class
+	allocated := a.allocatedPoolsNoLock()
+	for _, pool := range allocated {
+		if _, out := clipPool(pool, a.basePoolsNoLock()); len(out) > 0 {
+			diff.Orphaned = append(diff.Orphaned, pool)
+		}
+	}
+
+	// Add the parts of the base pools which are neither free, allocated, nor excluded
+	tracked := append(append(a.freePoolsNoLock(), allocated...), a.excluded...)
+	for _, pool := range base {
+		_, missing := clipPool(pool, tracked)
+		for _, p := range missing {
+			a.addPoolNoLock(c, p)
+		}
+		diff.Added = append(diff.Added, missing...)
+		tracked = append(tracked, missing...)
+	}
+	return diff
+}
+
+// freePoolsNoLock gives all of the free IPv4 and IPv6 pools of every class.
+func (a *LocalAllocator) freePoolsNoLock() []*net.IPNet {
+	var res []*net.IPNet
+	for _, name := range a.classNamesNoLock() {
+		res = append(res, a.classes[name].freePools()...)
+	}
+	return res
+}
+
+// allocatedPoolsNoLock gives all of the allocated pools.
+func (a *LocalAllocator) allocatedPoolsNoLock() []*net.IPNet {
+	var res []*net.IPNet
+	for str := range a.allocated {
+		_, pool, err := net.ParseCIDR(str)
+		if err == nil {
+			res = append(res, normalizePool(pool))
+		}
+	}
+	return res
+}
+
+// clipPool splits a normalized pool into the parts which lie within one of the given pools and the parts which overlap none of them.
+func clipPool(pool *net.IPNet, within []*net.IPNet) (in, out []*net.IPNet) {
+	overlap := false
+	for _, w := range within {
+		if poolContains(w, pool) {
+			return []*net.IPNet{pool}, nil
+		}
+		if poolOverlap(w, pool) {
+			overlap = true
+		}
+	}
+	if !overlap {
+		return nil, []*net.IPNet{pool}
+	}
+
+	// Some pool lies strictly inside this one, so split it and check each half
+	left, right := splitPool(pool)
+	lin, lout := clipPool(left, within)
+	rin, rout := clipPool(right, within)
+	return append(lin, rin...), append(lout, rout...)
+}
+
+// Allocation describes a pool in use outside of the allocator, along with the addresses in use within it.
+type Allocation struct {
+	Pool      *net.IPNet
+	Gateway   net.IP
+	Addresses []net.IP
+}
+
+// Drift describes the differences between the allocator and the pools and addresses actually in use.
+type Drift struct {
+	// MissingPools are pools in use which the allocator has free, along with their addresses.
+	MissingPools []*Allocation
+	// MissingAddresses are addresses in use within allocated pools which the allocator has free.
+	MissingAddresses []*Allocation
+	// StalePools are allocated pools which are not in use.
+	StalePools []*net.IPNet
+	// StaleAddresses are allocated addresses which are not in use, within pools which are.
+	StaleAddresses []*Allocation
+	// Conflicts are pools in use which overlap a different allocated pool, and cannot be corrected automatically.
+	Conflicts []*net.IPNet
+	// Unmanaged are pools in use which lie outside the free pools, such as outside every base pool.
+	Unmanaged []*net.IPNet
+	// Rejected are missing addresses which ApplyDrift could not allocate, such as reserved addresses.
+	Rejected []*Allocation
+}
+
+// Empty reports whether the allocator matches what is in use.
+func (d *Drift) Empty() bool {
+	return len(d.MissingPools) == 0 && len(d.MissingAddresses) == 0 && len(d.StalePools) == 0 &&
+		len(d.StaleAddresses) == 0 && len(d.Conflicts) == 0 && len(d.Unmanaged) == 0 && len(d.Rejected) == 0
+}
+
+// isRejection reports whether err is a request for an address being refused, rather than a failure to make the change.
+func isRejection(err error) bool {
+	switch err.(type) {
+	case ErrConflict, ErrInvalidArgument:
+		return true
+	}
+	return false
+}
+
+// DiffAllocations compares the allocator to the pools and addresses actually in use, without changing it.
+func (a *LocalAllocator) DiffAllocations(used []*Allocation) *Drift {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	drift := &Drift{}
+	seen := make(map[string]bool)
+
+	for _, u := range used {
+		pool := normalizePool(u.Pool)
+		if pool == nil {
+			continue
+		}
+
+		addrs, found := a.allocated[pool.String()]
+		if !found {
+			conflict := false
+			for _, allocated := range a.allocatedPoolsNoLock() {
+				if poolOverlap(pool, allocated) {
+					conflict = true
+				}
+			}
+
+			switch {
+			case conflict:
+				drift.Conflicts = append(drift.Conflicts, pool)
+			case a.isFreeNoLock(pool):
+				drift.MissingPools = append(drift.MissingPools, &Allocation{Pool: pool, Gateway: u.Gateway, Addresses: u.Addresses})
+			default:
+				drift.Unmanaged = append(drift.Unmanaged, pool)
+			}
+			continue
+		}
+		seen[pool.String()] = true
+
+		// The gateway is allocated like any other address in use
+		inUse := make(map[uint64]bool)
+		missing := &Allocation{Pool: pool}
+		if off, ok := addrs.offset(u.Gateway); ok {
+			inUse[off] = true
+			if !addrs.isSet(off) {
+				missing.Gateway = u.Gateway
+			}
+		}
+		for _, ip := range u.Addresses {
+			if off, ok := addrs.offset(ip); ok && !inUse[off] {
+				inUse[off] = true
+				if !addrs.isSet(off) {
+					missing.Addresses = append(missing.Addresses, ip)
+				}
+			}
+		}
+		if missing.Gateway != nil || len(missing.Addresses) > 0 {
+			drift.MissingAddresses = append(drift.MissingAddresses, missing)
+		}
+
+		stale := &Allocation{Pool: pool}
+		addrs.each(func(off uint64) {
+			if !inUse[off] {
+				stale.Addresses = append(stale.Addresses, addrs.ip(off))
+			}
+		})
+		if len(stale.Addresses) > 0 {
+			drift.StaleAddresses = append(drift.StaleAddresses, stale)
+		}
+	}
+
+	for _, pool := range a.allocatedPoolsNoLock() {
+		if !seen[pool.String()] {
+			drift.StalePools = append(drift.StalePools, pool)
+		}
+	}
+	return drift
+}
+
+// ApplyDrift allocates the missing pools and addresses of a drift, and releases the stale ones if prune is set.
+// The gateway in use in each pool is adopted before its addresses, so that an address the allocator had set aside for a
+// gateway of its own choosing may be given out. Addresses which still cannot be allocated, such as reserved addresses,
+// are added to the Rejected addresses of the drift instead of stopping the rest from being applied.
+// Conflicting and unmanaged pools are left for the operator to resolve.
+func (a *LocalAllocator) ApplyDrift(drift *Drift, prune bool) error {
+	for _, missing := range drift.MissingPools {
+		if _, err := a.RequestPool(DefaultClass, 0, false, missing.Pool); err != nil {
+			return err
+		}
+	}
+	for _, missing := range append(drift.MissingPools, drift.MissingAddresses...) {
+		rejected := &Allocation{Pool: missing.Pool}
+		if missing.Gateway != nil {
+			if _, err := a.RequestGateway(missing.Pool, missing.Gateway); err != nil {
+				if !isRejection(err) {
+					return err
+				}
+				rejected.Gateway = missing.Gateway
+			}
+		}
+		for _, ip := range missing.Addresses {
+			if ip.Equal(missing.Gateway) {
+				continue
+			}
+			if _, err := a.RequestAddress(missing.Pool, nil, ip); err != nil {
+				if !isRejection(err) {
+					return err
+				}
+				rejected.Addresses = append(rejected.Addresses, ip)
+			}
+		}
+		if rejected.Gateway != nil || len(rejected.Addresses) > 0 {
+			drift.Rejected = append(drift.Rejected, rejected)
+		}
+	}
+
+	if !prune {
+		return nil
+	}
+	for _, stale := range drift.StaleAddresses {
+		for _, ip := range stale.Addresses {
+			if err := a.ReleaseAddress(stale.Pool, ip); err != nil {
+				return err
+			}
+		}
+	}
+	for _, pool := range drift.StalePools {
+		if err := a.ReleasePool(pool); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isFreeNoLock reports whether a normalized pool lies within one of the free pools.
+func (a *LocalAllocator) isFreeNoLock(pool *net.IPNet) bool {
+	for _, free := range a.freePoolsNoLock() {
+		if poolContains(free, pool) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package allocator
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReconcileClassesOrphans(t *testing.T) {
+	a := NewLocalAllocator(NewMemoryStore())
+	if _, err := a.ReconcileClasses(map[string][]*net.IPNet{
+		DefaultClass: {mustParsePool(t, "10.0.0.0/16")},
+		"ci":         {mustParsePool(t, "10.1.0.0/16")},
+		"qa":         {mustParsePool(t, "10.2.0.0/16")},
+		"staging":    {mustParsePool(t, "10.3.0.0/16")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ci, err := a.RequestPool("ci", 24, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qa, err := a.RequestPool("qa", 24, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ci is dropped, orphaning its pool, and the range of qa moves to staging, which keeps its pool in a class
+	diffs, err := a.ReconcileClasses(map[string][]*net.IPNet{
+		DefaultClass: {mustParsePool(t, "10.0.0.0/16")},
+		"staging":    {mustParsePool(t, "10.2.0.0/15")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{DefaultClass, "ci", "qa", "staging"} {
+		diff, found := diffs[name]
+		if !found {
+			t.Errorf("no diff for class %s", name)
+			continue
+		}
+		var want []string
+		if name == DefaultClass {
+			want = []string{ci.String()}
+		}
+		if got := poolStrings(diff.Orphaned); !equalStrings(got, want) {
+			t.Errorf("class %s has orphaned pools %v, want %v", name, got, want)
+		}
+	}
+	usage, err := a.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if class := usage.ClassOf(qa); class != "staging" {
+		t.Errorf("pool %s is in class %q after its range moved, want staging", qa, class)
+	}
+}
+
+func poolStrings(pools []*net.IPNet) []string {
+	var res []string
+	for _, pool := range pools {
+		res = append(res, pool.String())
+	}
+	return res
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestApplyDrift(t *testing.T) {
+	ips := func(strs ...string) []net.IP {
+		var res []net.IP
+		for _, str := range strs {
+			res = append(res, net.ParseIP(str))
+		}
+		return res
+	}
+
+	tests := []struct {
+		name         string
+		used         *Allocation
+		wantAddrs    []string // Allocated addresses of the pool, including the gateway
+		wantGateway  string
+		wantRejected []string
+	}{
+		{
+			name:        "gateway and addresses",
+			used:        &Allocation{Gateway: net.ParseIP("10.0.0.3"), Addresses: ips("10.0.0.4", "10.0.0.5")},
+			wantAddrs:   []string{"10.0.0.3", "10.0.0.4", "10.0.0.5"},
+			wantGateway: "10.0.0.3",
+		},
+		{
+			// The allocator would have chosen 10.0.0.3, which is free to give out once Docker's gateway is adopted
+			name:        "gateway elsewhere",
+			used:        &Allocation{Gateway: net.ParseIP("10.0.0.14"), Addresses: ips("10.0.0.3", "10.0.0.4")},
+			wantAddrs:   []string{"10.0.0.3", "10.0.0.4", "10.0.0.14"},
+			wantGateway: "10.0.0.14",
+		},
+		{
+			name:         "no gateway",
+			used:         &Allocation{Addresses: ips("10.0.0.3", "10.0.0.4")},
+			wantAddrs:    []string{"10.0.0.4"},
+			wantGateway:  "10.0.0.3",
+			wantRejected: []string{"10.0.0.3"},
+		},
+		{
+			name:         "reserved addresses",
+			used:         &Allocation{Gateway: net.ParseIP("10.0.0.1"), Addresses: ips("10.0.0.2", "10.0.0.4")},
+			wantAddrs:    []string{"10.0.0.4"},
+			wantGateway:  "10.0.0.3",
+			wantRejected: []string{"10.0.0.1", "10.0.0.2"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := NewLocalAllocator(NewMemoryStore())
+			a.SetReservedOffsets([]OffsetRange{{First: 1, Last: 2}})
+			if err := a.AddPool(mustParsePool(t, "10.0.0.0/24")); err != nil {
+				t.Fatal(err)
+			}
+
+			pool := mustParsePool(t, "10.0.0.0/28")
+			test.used.Pool = pool
+			drift := a.DiffAllocations([]*Allocation{test.used})
+			if len(drift.MissingPools) != 1 {
+				t.Fatalf("got %d missing pools, want 1", len(drift.MissingPools))
+			}
+			if err := a.ApplyDrift(drift, false); err != nil {
+				t.Fatal(err)
+			}
+
+			st, err := a.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := st.Addresses[pool.String()]; !equalStrings(got, test.wantAddrs) {
+				t.Errorf("allocated addresses %v, want %v", got, test.wantAddrs)
+			}
+			if got := st.Gateways[pool.String()]; got != test.wantGateway {
+				t.Errorf("gateway %s, want %s", got, test.wantGateway)
+			}
+
+			var rejected []string
+			for _, r := range drift.Rejected {
+				if r.Gateway != nil {
+					rejected = append(rejected, r.Gateway.String())
+				}
+				for _, ip := range r.Addresses {
+					rejected = append(rejected, ip.String())
+				}
+			}
+			if !equalStrings(rejected, test.wantRejected) {
+				t.Errorf("rejected %v, want %v", rejected, test.wantRejected)
+			}
+		})
+	}
+}
@@ -0,0 +1,497 @@
+package allocator
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// StateVersion is the version of the State format written by this package.
+const StateVersion = 1
+
+const (
+	stateFileName    = "state.json"
+	gobStateFileName = "state.gob"
+)
+
+// legacyStateFile is where state was saved before it was kept in a state directory.
+var legacyStateFile = filepath.Join(os.TempDir(), "mini-ipam.gob")
+
+// State is the saved form of a LocalAllocator.
+// It is written as indented JSON so that it can be inspected and edited by hand.
+type State struct {
+	Version  int           `json:"version"`
+	Metadata StateMetadata `json:"metadata"`
+
+	// Base are the pools added to the default pool class.
+	Base []string `json:"base"`
+	// Free are the pools of the default pool class available to be allocated.
+	Free []string `json:"free"`
+	// Classes are the other pool classes, keyed by name.
+	Classes map[string]*ClassState `json:"classes,omitempty"`
+	// Allocated are the pools which have been handed out.
+	Allocated []string `json:"allocated"`
+	// Addresses are the addresses allocated in each allocated pool, keyed by pool.
+	Addresses map[string][]string `json:"addresses"`
+	// Gateways are the addresses reserved for the gateway of each allocated pool, keyed by pool.
+	Gateways map[string]string `json:"gateways,omitempty"`
+	// Excluded are the subnets which are never handed out.
+	Excluded []string `json:"excluded,omitempty"`
+	// Reserved are the address offset ranges never assigned in each allocated pool, keyed by pool.
+	Reserved map[string][]string `json:"reserved,omitempty"`
+	// Leases are the pools last allocated for each sticky key, keyed by sticky key.
+	Leases map[string][]string `json:"leases,omitempty"`
+	// AddressLeases are the addresses last allocated for each MAC address in each allocated pool, keyed by pool then MAC address.
+	AddressLeases map[string]map[string]string `json:"address_leases,omitempty"`
+	// JournalSeq is the sequence number of the last journal entry included in the state.
+	JournalSeq uint64 `json:"journal_seq,omitempty"`
+}
+
+// ClassState is the saved form of a pool class.
+type ClassState struct {
+	Base []string `json:"base"`
+	Free []string `json:"free"`
+}
+
+// FreePools gives the free pools of every class.
+func (st *State) FreePools() []string {
+	res := append([]string(nil), st.Free...)
+	for _, cs := range st.Classes {
+		res = append(res, cs.Free...)
+	}
+	sortAddrs(res)
+	return res
+}
+
+// BasePools gives the base pools of every class.
+func (st *State) BasePools() []string {
+	res := append([]string(nil), st.Base...)
+	for _, cs := range st.Classes {
+		res = append(res, cs.Base...)
+	}
+	sortAddrs(res)
+	return res
+}
+
+// ClassOf gives the name of the class whose base pools contain pool, or "" if no class does.
+func (st *State) ClassOf(pool string) string {
+	p, err := parsePool(pool)
+	if err != nil {
+		return ""
+	}
+	contains := func(bases []string) bool {
+		for _, str := range bases {
+			if base, err := parsePool(str); err == nil && poolContains(base, p) {
+				return true
+			}
+		}
+		return false
+	}
+	if contains(st.Base) {
+		return DefaultClass
+	}
+	for name, cs := range st.Classes {
+		if contains(cs.Base) {
+			return name
+		}
+	}
+	return ""
+}
+
+// StateMetadata records when and where a State was saved.
+type StateMetadata struct {
+	SavedAt  time.Time `json:"saved_at"`
+	Hostname string    `json:"hostname,omitempty"`
+}
+
+// snapshotNoLock captures the current state of the allocator.
+func (a *LocalAllocator) snapshotNoLock() *State {
+	st := &State{
+		Version:   StateVersion,
+		Addresses: make(map[string][]string),
+		Gateways:  make(map[string]string),
+		Reserved:  make(map[string][]string),
+	}
+	st.JournalSeq = a.seq
+	st.Metadata.SavedAt = time.Now().UTC()
+	st.Metadata.Hostname, _ = os.Hostname()
+
+	for name, c := range a.classes {
+		cs := &ClassState{}
+		for _, pool := range c.base {
+			cs.Base = append(cs.Base, pool.String())
+		}
+		for _, pool := range c.freePools() {
+			cs.Free = append(cs.Free, pool.String())
+		}
+		sortAddrs(cs.Base)
+		sortAddrs(cs.Free)
+
+		if name == DefaultClass {
+			st.Base, st.Free = cs.Base, cs.Free
+		} else {
+			if st.Classes == nil {
+				st.Classes = make(map[string]*ClassState)
+			}
+			st.Classes[name] = cs
+		}
+	}
+	for _, pool := range a.excluded {
+		st.Excluded = append(st.Excluded, pool.String())
+	}
+
+	for pool, addrs := range a.allocated {
+		st.Allocated = append(st.Allocated, pool)
+		if addrs.count > 0 {
+			st.Addresses[pool] = addrs.addrs()
+		}
+		if addrs.hasGateway {
+			st.Gateways[pool] = addrs.ip(addrs.gateway).String()
+		}
+		for _, r := range addrs.reserved {
+			st.Reserved[pool] = append(st.Reserved[pool], r.String())
+		}
+		for mac, off := range addrs.leases {
+			if st.AddressLeases == nil {
+				st.AddressLeases = make(map[string]map[string]string)
+			}
+			if st.AddressLeases[pool] == nil {
+				st.AddressLeases[pool] = make(map[string]string)
+			}
+			st.AddressLeases[pool][mac] = addrs.ip(off).String()
+		}
+	}
+
+	for key, pools := range a.leases {
+		if st.Leases == nil {
+			st.Leases = make(map[string][]string)
+		}
+		for _, pool := range pools {
+			st.Leases[key] = append(st.Leases[key], pool.String())
+		}
+		sortAddrs(st.Leases[key])
+	}
+
+	sortAddrs(st.Allocated)
+	sortAddrs(st.Excluded)
+	for _, addrs := range st.Addresses {
+		sortAddrs(addrs)
+	}
+	return st
+}
+
+// Snapshot gives the current state of the allocator.
+func (a *LocalAllocator) Snapshot() (*State, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.snapshotNoLock(), nil
+}
+
+// ImportState replaces the state saved in store with st, which is checked before it is saved.
+// Any journaled changes are discarded, since they applied to the replaced state.
+func ImportState(store Store, st *State) error {
+	a := &LocalAllocator{}
+	a.reset()
+	if err := a.restoreNoLock(st); err != nil {
+		return err
+	}
+
+	imported := a.snapshotNoLock()
+	imported.Metadata = st.Metadata
+	imported.JournalSeq = 0
+	if err := store.Apply(replaceState(imported)); err != nil {
+		return err
+	}
+	return store.Compact(math.MaxUint64)
+}
+
+// restoreNoLock sets the allocator to a saved state.
+func (a *LocalAllocator) restoreNoLock(st *State) error {
+	if st.Version < 1 || st.Version > StateVersion {
+		return fmt.Errorf("Unsupported state version: %d", st.Version)
+	}
+
+	classes := map[string]*ClassState{DefaultClass: {Base: st.Base, Free: st.Free}}
+	for name, cs := range st.Classes {
+		if name == DefaultClass || !ValidClassName(name) {
+			return fmt.Errorf("Invalid pool class name: %q", name)
+		}
+		classes[name] = cs
+	}
+	for name, cs := range classes {
+		c := newPoolClass()
+		for _, str := range cs.Base {
+			pool, err := parsePool(str)
+			if err != nil {
+				return err
+			}
+			c.base = append(c.base, pool)
+		}
+		for _, str := range cs.Free {
+			pool, err := parsePool(str)
+			if err != nil {
+				return err
+			}
+			masklen, bits := pool.Mask.Size()
+			pools := c.freeLists(bits)
+			pools[masklen] = append(pools[masklen], pool)
+		}
+		a.classes[name] = c
+	}
+
+	for _, str := range st.Allocated {
+		pool, err := parsePool(str)
+		if err != nil {
+			return err
+		}
+		a.allocated[pool.String()] = newAddrBitmap(pool)
+	}
+
+	for str, addrs := range st.Addresses {
+		pool, err := parsePool(str)
+		if err != nil {
+			return err
+		}
+		bitmap, found := a.allocated[pool.String()]
+		if !found {
+			return fmt.Errorf("Read addresses for unallocated pool: %s", str)
+		}
+		for _, addr := range addrs {
+			off, ok := bitmap.offset(net.ParseIP(addr))
+			if !ok {
+				return fmt.Errorf("Read invalid address for pool %s: %s", str, addr)
+			}
+			bitmap.set(off)
+		}
+	}
+
+	for str, gateway := range st.Gateways {
+		pool, err := parsePool(str)
+		if err != nil {
+			return err
+		}
+		bitmap, found := a.allocated[pool.String()]
+		if !found {
+			return fmt.Errorf("Read gateway for unallocated pool: %s", str)
+		}
+		off, ok := bitmap.offset(net.ParseIP(gateway))
+		if !ok {
+			return fmt.Errorf("Read invalid gateway for pool %s: %s", str, gateway)
+		}
+		bitmap.gateway, bitmap.hasGateway = off, true
+	}
+
+	for _, str := range st.Excluded {
+		pool, err := parsePool(str)
+		if err != nil {
+			return err
+		}
+		a.excluded = append(a.excluded, pool)
+	}
+
+	for str, ranges := range st.Reserved {
+		pool, err := parsePool(str)
+		if err != nil {
+			return err
+		}
+		bitmap, found := a.allocated[pool.String()]
+		if !found {
+			return fmt.Errorf("Read reserved addresses for unallocated pool: %s", str)
+		}
+		for _, r := range ranges {
+			offsets, err := ParseOffsetRange(r)
+			if err != nil {
+				return err
+			}
+			bitmap.reserved = append(bitmap.reserved, offsets)
+		}
+	}
+
+	for str, leases := range st.AddressLeases {
+		pool, err := parsePool(str)
+		if err != nil {
+			return err
+		}
+		bitmap, found := a.allocated[pool.String()]
+		if !found {
+			return fmt.Errorf("Read address leases for unallocated pool: %s", str)
+		}
+		for mac, addr := range leases {
+			hw, err := net.ParseMAC(mac)
+			if err != nil {
+				return fmt.Errorf("Read invalid MAC address for pool %s: %s", str, mac)
+			}
+			off, ok := bitmap.offset(net.ParseIP(addr))
+			if !ok {
+				return fmt.Errorf("Read invalid leased address for pool %s: %s", str, addr)
+			}
+			bitmap.lease(hw.String(), off)
+		}
+	}
+
+	for key, strs := range st.Leases {
+		if key == "" {
+			return fmt.Errorf("Read lease with an empty sticky key")
+		}
+		for _, str := range strs {
+			pool, err := parsePool(str)
+			if err != nil {
+				return err
+			}
+			a.leases[key] = append(a.leases[key], pool)
+		}
+	}
+
+	a.seq = st.JournalSeq
+	return nil
+}
+
+// Save the allocator's current state to its store
+func (a *LocalAllocator) save() error {
+	a.saveLock.Lock()
+	defer a.saveLock.Unlock()
+
+	a.lock.RLock()
+	st := a.snapshotNoLock()
+	a.lock.RUnlock()
+
+	if err := a.store.Apply(replaceState(st)); err != nil {
+		return err
+	}
+	// The journal entries are now part of the snapshot
+	return a.store.Compact(st.JournalSeq)
+}
+
+// Load the allocator state saved in its store, replaying any changes journaled since
+func (a *LocalAllocator) load() error {
+	entries, err := a.store.Entries()
+	if err != nil {
+		return err
+	}
+	st, err := a.store.Load()
+	if os.IsNotExist(err) && len(entries) > 0 {
+		// Changes were journaled before the first snapshot was saved
+		st, err = &State{Version: StateVersion}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Set this object to the initial state
+	a.init()
+
+	a.lock.Lock()
+	err = a.restoreNoLock(st)
+	a.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return a.replay(entries)
+}
+
+// readStateFile reads a JSON state file.
+func readStateFile(path string) (*State, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &State{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("Failed to parse state file %s: %s", path, err)
+	}
+	return st, nil
+}
+
+// readGobStateFile reads the gob encoded Dump written by older versions and converts it to a State.
+func readGobStateFile(path string) (*State, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dump := make(map[string][]string)
+	d := gob.NewDecoder(bytes.NewReader(data))
+	if err := d.Decode(&dump); err != nil {
+		return nil, fmt.Errorf("Failed to parse state file %s: %s", path, err)
+	}
+
+	st := &State{
+		Version:   StateVersion,
+		Base:      dump["base"],
+		Free:      dump["free"],
+		Addresses: make(map[string][]string),
+	}
+
+	// Allocated pools and addresses were mixed together, so split them apart
+	var pools []*net.IPNet
+	for _, str := range dump["allocated"] {
+		if pool, err := parsePool(str); err == nil {
+			pools = append(pools, pool)
+			st.Allocated = append(st.Allocated, pool.String())
+		}
+	}
+	for _, str := range dump["allocated"] {
+		ip := net.ParseIP(str)
+		if ip == nil {
+			continue
+		}
+		// Addresses outside every allocated pool were leaked when their pool was released, so drop them
+		for _, pool := range pools {
+			if pool.Contains(ip) {
+				st.Addresses[pool.String()] = append(st.Addresses[pool.String()], ip.String())
+				break
+			}
+		}
+	}
+
+	// Older dumps did not record the base pools, so assume everything tracked is in bounds
+	if _, found := dump["base"]; !found {
+		st.Base = append(append([]string{}, st.Free...), st.Allocated...)
+	}
+
+	return st, nil
+}
+
+// parsePool parses a CIDR string into a normalized pool.
+func parsePool(str string) (*net.IPNet, error) {
+	_, pool, err := net.ParseCIDR(str)
+	if err != nil {
+		return nil, err
+	}
+	pool = normalizePool(pool)
+	if pool == nil {
+		return nil, fmt.Errorf("Read invalid pool: %s", str)
+	}
+	return pool, nil
+}
+
+// sortAddrs sorts pool and address strings into address order, which reads better than lexical order.
+func sortAddrs(strs []string) {
+	key := func(str string) (net.IP, int) {
+		if ip, pool, err := net.ParseCIDR(str); err == nil {
+			masklen, _ := pool.Mask.Size()
+			return ip.To16(), masklen
+		}
+		return net.ParseIP(str).To16(), 0
+	}
+
+	sort.Slice(strs, func(i, j int) bool {
+		ipi, leni := key(strs[i])
+		ipj, lenj := key(strs[j])
+		if c := bytes.Compare(ipi, ipj); c != 0 {
+			return c < 0
+		}
+		return leni < lenj
+	})
+}
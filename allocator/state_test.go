@@ -0,0 +1,66 @@
+package allocator
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadGobStateFile(t *testing.T) {
+	// The dump saved by older versions, which mixed allocated pools and addresses and did not record the base pools
+	st, err := readGobStateFile(filepath.Join("testdata", "legacy-state.gob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &State{
+		Version:   StateVersion,
+		Free:      []string{"172.16.0.32/27", "172.16.0.64/26", "172.16.0.128/25", "172.16.1.0/24"},
+		Allocated: []string{"172.16.0.0/28", "172.16.0.16/28"},
+		Addresses: map[string][]string{
+			"172.16.0.0/28":  {"172.16.0.2", "172.16.0.3"},
+			"172.16.0.16/28": {"172.16.0.18"},
+		},
+		Base: []string{"172.16.0.32/27", "172.16.0.64/26", "172.16.0.128/25", "172.16.1.0/24", "172.16.0.0/28", "172.16.0.16/28"},
+	}
+	if !reflect.DeepEqual(st, want) {
+		t.Errorf("migrated state is %+v, want %+v", st, want)
+	}
+}
+
+func TestFileStoreMigratesGobState(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "legacy-state.gob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, gobStateFileName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	a, err := LoadLocalAllocator(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, stateFileName)); err != nil {
+		t.Errorf("state was not rewritten in the current format: %s", err)
+	}
+
+	// The migrated allocator carries on from the legacy state
+	if _, err := a.RequestAddress(mustParsePool(t, "172.16.0.0/28"), nil, nil); err != nil {
+		t.Error(err)
+	}
+	pool, err := a.RequestPool(DefaultClass, 27, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool.String() != "172.16.0.32/27" {
+		t.Errorf("got pool %s, want the free 172.16.0.32/27", pool)
+	}
+}
@@ -0,0 +1,55 @@
+package allocator
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// FreeCount is the number of free pools of one mask length in a pool class.
+type FreeCount struct {
+	Class      string
+	V6         bool
+	MaskLength int
+	Pools      int
+	Addresses  float64 // Total addresses in the pools, which for IPv6 may be too many for an integer
+}
+
+// Stats summarizes the utilization of a LocalAllocator.
+type Stats struct {
+	Free               []FreeCount // Free pools of each class and mask length which has any
+	AllocatedPools     int
+	AllocatedAddresses uint64
+	SaveFailures       uint64 // Snapshots which could not be saved
+	JournalFailures    uint64 // Changes which were refused because they could not be recorded in the journal
+}
+
+// Stats gives the current utilization of the allocator.
+func (a *LocalAllocator) Stats() *Stats {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	stats := &Stats{
+		AllocatedPools:  len(a.allocated),
+		SaveFailures:    atomic.LoadUint64(&a.saveFailures),
+		JournalFailures: atomic.LoadUint64(&a.journalFailures),
+	}
+	for _, name := range a.classNamesNoLock() {
+		for _, bits := range []int{32, 128} {
+			for masklen, pools := range a.classes[name].freeLists(bits) {
+				if len(pools) > 0 {
+					stats.Free = append(stats.Free, FreeCount{
+						Class:      name,
+						V6:         bits == 128,
+						MaskLength: masklen,
+						Pools:      len(pools),
+						Addresses:  math.Ldexp(float64(len(pools)), bits-masklen),
+					})
+				}
+			}
+		}
+	}
+	for _, addrs := range a.allocated {
+		stats.AllocatedAddresses += addrs.count
+	}
+	return stats
+}
@@ -0,0 +1,189 @@
+package allocator
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// Store persists the state of a LocalAllocator.
+type Store interface {
+	// Load gives the saved state.
+	// An error satisfying os.IsNotExist is returned if there is no saved state.
+	Load() (*State, error)
+
+	// Apply changes the saved state with m and saves the result, as a single atomic update.
+	// If there is no saved state, m is given an empty State.
+	Apply(m Mutation) error
+
+	// Watch gives a channel which receives the state after each update, until stop is closed.
+	// Updates are coalesced, so a slow reader only misses intermediate states.
+	// The states received are shared and must not be modified.
+	Watch(stop <-chan struct{}) <-chan *State
+
+	// Append durably records a change made after the saved state, before returning.
+	Append(e *JournalEntry) error
+
+	// Entries gives the recorded journal entries in the order they were appended.
+	Entries() ([]*JournalEntry, error)
+
+	// Compact drops the journal entries up to and including seq, once they are part of the saved state.
+	Compact(seq uint64) error
+
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// Mutation changes a State in place.
+type Mutation func(st *State) error
+
+// replaceState gives a Mutation which overwrites the saved state with st.
+func replaceState(st *State) Mutation {
+	return func(saved *State) error {
+		*saved = *st
+		return nil
+	}
+}
+
+// cloneState makes a deep copy of st so it can be changed without affecting the original.
+func cloneState(st *State) (*State, error) {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+	res := &State{}
+	return res, json.Unmarshal(data, res)
+}
+
+// compactEntries gives the entries after seq.
+func compactEntries(entries []*JournalEntry, seq uint64) []*JournalEntry {
+	var res []*JournalEntry
+	for _, e := range entries {
+		if e.Seq > seq {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// watchers tracks the channels handed out by Store.Watch.
+type watchers struct {
+	lock  sync.Mutex
+	chans map[chan *State]struct{}
+}
+
+// add registers a new watch channel which is closed and removed when stop is closed.
+func (w *watchers) add(stop <-chan struct{}) <-chan *State {
+	ch := make(chan *State, 1)
+
+	w.lock.Lock()
+	if w.chans == nil {
+		w.chans = make(map[chan *State]struct{})
+	}
+	w.chans[ch] = struct{}{}
+	w.lock.Unlock()
+
+	go func() {
+		<-stop
+		w.lock.Lock()
+		delete(w.chans, ch)
+		close(ch)
+		w.lock.Unlock()
+	}()
+	return ch
+}
+
+// notify sends st to every watcher, replacing any state it has not yet received.
+func (w *watchers) notify(st *State) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for ch := range w.chans {
+		select {
+		case ch <- st:
+		default:
+			// Only notify sends, so once the stale state is drained there is room for this one
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- st
+		}
+	}
+}
+
+// MemoryStore is a Store which keeps the state in process memory.
+// Nothing survives a restart, which makes it suited to testing and throwaway hosts.
+type MemoryStore struct {
+	lock     sync.Mutex
+	state    *State
+	journal  []*JournalEntry
+	watchers watchers
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (m *MemoryStore) Load() (*State, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.state == nil {
+		return nil, &os.PathError{Op: "load", Path: "memory", Err: os.ErrNotExist}
+	}
+	return cloneState(m.state)
+}
+
+func (m *MemoryStore) Apply(mut Mutation) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	st := &State{Version: StateVersion}
+	if m.state != nil {
+		var err error
+		if st, err = cloneState(m.state); err != nil {
+			return err
+		}
+	}
+	if err := mut(st); err != nil {
+		return err
+	}
+
+	m.state = st
+	m.watchers.notify(st)
+	return nil
+}
+
+func (m *MemoryStore) Watch(stop <-chan struct{}) <-chan *State {
+	return m.watchers.add(stop)
+}
+
+func (m *MemoryStore) Append(e *JournalEntry) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry := *e
+	m.journal = append(m.journal, &entry)
+	return nil
+}
+
+func (m *MemoryStore) Entries() ([]*JournalEntry, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return append([]*JournalEntry(nil), m.journal...), nil
+}
+
+func (m *MemoryStore) Compact(seq uint64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.journal = compactEntries(m.journal, seq)
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,91 @@
+package allocator
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreWatch(t *testing.T) {
+	stores := []struct {
+		name string
+		open func(t *testing.T) Store
+	}{
+		{"memory", func(t *testing.T) Store { return NewMemoryStore() }},
+		{"file", func(t *testing.T) Store {
+			s, err := NewFileStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		}},
+		{"bolt", func(t *testing.T) Store {
+			s, err := NewBoltStore(filepath.Join(t.TempDir(), "state.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		}},
+	}
+
+	for _, test := range stores {
+		t.Run(test.name, func(t *testing.T) {
+			s := test.open(t)
+			defer s.Close()
+
+			stop := make(chan struct{})
+			ch := s.Watch(stop)
+
+			setFree := func(pool string) {
+				t.Helper()
+				if err := s.Apply(func(st *State) error {
+					st.Free = []string{pool}
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			setFree("10.0.0.0/24")
+			if st := receive(t, ch); len(st.Free) != 1 || st.Free[0] != "10.0.0.0/24" {
+				t.Errorf("watcher got free pools %v after the first update, want [10.0.0.0/24]", st.Free)
+			}
+
+			// A watcher which falls behind only sees the latest state
+			setFree("10.1.0.0/24")
+			setFree("10.2.0.0/24")
+			if st := receive(t, ch); len(st.Free) != 1 || st.Free[0] != "10.2.0.0/24" {
+				t.Errorf("watcher got free pools %v after falling behind, want [10.2.0.0/24]", st.Free)
+			}
+
+			// A failed mutation is not sent
+			s.Apply(func(st *State) error { return invalidf("refused") })
+			select {
+			case st := <-ch:
+				t.Errorf("watcher got state %v from a failed update", st.Free)
+			default:
+			}
+
+			close(stop)
+			select {
+			case _, ok := <-ch:
+				if ok {
+					t.Error("watcher got a state after it was stopped")
+				}
+			case <-time.After(time.Second):
+				t.Error("watch channel was not closed when stopped")
+			}
+		})
+	}
+}
+
+func receive(t *testing.T, ch <-chan *State) *State {
+	t.Helper()
+	select {
+	case st := <-ch:
+		return st
+	case <-time.After(time.Second):
+		t.Fatal("watcher did not receive the update")
+		return nil
+	}
+}
@@ -0,0 +1,55 @@
+package allocator
+
+import (
+	"net"
+)
+
+// Usage summarizes what has been allocated from an allocator, so limits can be enforced on further requests.
+type Usage struct {
+	// Pools and Pools6 are the numbers of allocated IPv4 and IPv6 pools in each class. Pools outside of every class are not counted.
+	Pools  map[string]int
+	Pools6 map[string]int
+	// Addresses is the total number of addresses in allocated IPv4 pools.
+	Addresses uint64
+	// Bases are the base pools of each class.
+	Bases map[string][]*net.IPNet
+}
+
+// ClassOf gives the class whose base pools contain pool, or "" if there is none.
+func (u *Usage) ClassOf(pool *net.IPNet) string {
+	for name, bases := range u.Bases {
+		for _, base := range bases {
+			if poolContains(base, normalizePool(pool)) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// Usage gives what has been allocated from the allocator.
+func (a *LocalAllocator) Usage() (*Usage, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return a.usageNoLock(), nil
+}
+
+func (a *LocalAllocator) usageNoLock() *Usage {
+	u := &Usage{Pools: make(map[string]int), Pools6: make(map[string]int), Bases: make(map[string][]*net.IPNet)}
+	for name, c := range a.classes {
+		u.Bases[name] = append([]*net.IPNet(nil), c.base...)
+	}
+	for _, pool := range a.allocatedPoolsNoLock() {
+		counts := u.Pools
+		if masklen, bits := pool.Mask.Size(); bits == 8*net.IPv4len {
+			u.Addresses += 1 << uint(bits-masklen)
+		} else {
+			counts = u.Pools6
+		}
+		if class := u.ClassOf(pool); class != "" {
+			counts[class]++
+		}
+	}
+	return u
+}
@@ -71,7 +71,7 @@ func Add(a []byte, n int32, dst []byte) []byte {
         if i < len(a) {
             carry += int32(a[i])
         }
-        dst[i], carry = byte(carry % 0xFF), carry / 0xFF
+        dst[i], carry = byte(carry % 0x100), carry / 0x100
     }
 
     return dst
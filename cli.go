@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nategraf/mini-ipam-driver/admin"
+	"github.com/nategraf/mini-ipam-driver/allocator"
+	"github.com/nategraf/mini-ipam-driver/driver"
+)
+
+const usage = `Usage: mini-ipam [command] [flags] [args]
+
+Commands:
+  serve                      run the IPAM plugin (the default)
+  status                     summarize the allocator state
+  pools list                 list allocated and free pools
+  release <pool-id>          release an allocated pool, such as local:172.16.0.0/28
+  state export [file]        write the allocator state as JSON to a file or stdout
+  state import <file>        replace the saved allocator state, while the driver is stopped
+
+Commands other than serve ask the running driver through its admin API, and if "admin" is empty or
+its socket does not exist read the saved state directly, which only works while the driver is stopped.
+Run "mini-ipam <command> -h" for the flags, which are the same as for serve.
+`
+
+// runCommand runs a subcommand, giving the process exit code.
+func runCommand(cmd string, args []string) int {
+	name := cmd
+	if cmd == "pools" || cmd == "state" {
+		// These take a second word naming the action
+		if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+			fmt.Fprint(os.Stderr, usage)
+			return 2
+		}
+		name, args = cmd+" "+args[0], args[1:]
+	}
+
+	switch name {
+	case "serve", "status", "pools list", "release", "state export", "state import":
+	case "help", "-h", "--help":
+		fmt.Fprint(os.Stdout, usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n%s", name, usage)
+		return 2
+	}
+
+	// Positional args may come before or after the flags
+	var pos []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		pos, args = append(pos, args[0]), args[1:]
+	}
+	conf, rest, err := loadConfig("mini-ipam "+name, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %s\n", err)
+		return 2
+	}
+	pos = append(pos, rest...)
+
+	if name == "serve" {
+		serve(conf)
+		return 0
+	}
+
+	if err := runOperatorCommand(name, conf, pos, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runOperatorCommand runs one of the commands for inspecting or changing the state, writing its output to w.
+func runOperatorCommand(name string, conf *Config, args []string, w io.Writer) error {
+	if name == "state import" {
+		if len(args) != 1 {
+			return fmt.Errorf("Usage: mini-ipam state import <file>")
+		}
+		return importState(conf, args[0])
+	}
+
+	b, err := openBackend(conf)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	switch name {
+	case "status":
+		return printStatus(b, w)
+	case "pools list":
+		return printPools(b, w)
+	case "release":
+		if len(args) != 1 {
+			return fmt.Errorf("Usage: mini-ipam release <pool-id>")
+		}
+		return releasePool(b, args[0], w)
+	case "state export":
+		if len(args) > 1 {
+			return fmt.Errorf("Usage: mini-ipam state export [file]")
+		}
+		return exportState(b, args, w)
+	}
+	return nil
+}
+
+// backend gives the operator commands access to the allocators, through the running driver or the saved state.
+type backend interface {
+	// Spaces gives the names of the address spaces which are configured.
+	Spaces() []string
+	State(space string) (*allocator.State, error)
+	ReleasePool(space string, pool *net.IPNet) error
+	Close() error
+}
+
+func openBackend(conf *Config) (backend, error) {
+	// The admin socket only exists while the driver is running
+	if conf.Admin != "" && !socketMissing(conf.Admin) {
+		return &daemonBackend{client: admin.NewClient(conf.Admin), global: conf.GlobalStore != ""}, nil
+	}
+
+	store, err := conf.OpenStore()
+	if err != nil {
+		return nil, fmt.Errorf("%s\nIf the driver is running, configure \"admin\" to query it instead", err)
+	}
+	a, err := allocator.LoadLocalAllocator(store)
+	if os.IsNotExist(err) {
+		a, err = allocator.NewLocalAllocator(store), nil
+	}
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	b := &offlineBackend{allocators: map[string]allocator.Allocator{"local": a}, local: a, store: store}
+	if conf.GlobalStore != "" {
+		kv, key, _ := allocator.ParseKVStore(conf.GlobalStore)
+		b.allocators["global"] = allocator.NewGlobalAllocator(kv, key)
+	}
+	return b, nil
+}
+
+// socketMissing reports whether addr is the path of a Unix socket which does not exist.
+func socketMissing(addr string) bool {
+	path := strings.TrimPrefix(addr, "unix://")
+	if !strings.HasPrefix(path, "/") {
+		return false
+	}
+	_, err := os.Stat(path)
+	return os.IsNotExist(err)
+}
+
+// daemonBackend uses the admin API of the running driver.
+type daemonBackend struct {
+	client *admin.Client
+	global bool
+}
+
+func (b *daemonBackend) Spaces() []string {
+	if b.global {
+		return []string{"local", "global"}
+	}
+	return []string{"local"}
+}
+
+func (b *daemonBackend) State(space string) (*allocator.State, error) {
+	return b.client.State(space)
+}
+
+func (b *daemonBackend) ReleasePool(space string, pool *net.IPNet) error {
+	return b.client.ReleasePool(space, pool)
+}
+
+func (b *daemonBackend) Close() error {
+	return nil
+}
+
+// offlineBackend uses the saved state directly, holding the lock on it until closed.
+type offlineBackend struct {
+	allocators map[string]allocator.Allocator
+	local      *allocator.LocalAllocator
+	store      allocator.Store
+	changed    bool
+}
+
+func (b *offlineBackend) Spaces() []string {
+	if _, found := b.allocators["global"]; found {
+		return []string{"local", "global"}
+	}
+	return []string{"local"}
+}
+
+func (b *offlineBackend) allocator(space string) (allocator.Allocator, error) {
+	a, found := b.allocators[space]
+	if !found {
+		return nil, fmt.Errorf("Unknown address space: %s", space)
+	}
+	return a, nil
+}
+
+func (b *offlineBackend) State(space string) (*allocator.State, error) {
+	a, err := b.allocator(space)
+	if err != nil {
+		return nil, err
+	}
+	return a.Snapshot()
+}
+
+func (b *offlineBackend) ReleasePool(space string, pool *net.IPNet) error {
+	a, err := b.allocator(space)
+	if err != nil {
+		return err
+	}
+	b.changed = true
+	return a.ReleasePool(pool)
+}
+
+// Close saves the local state if it was changed, and releases the lock on it.
+func (b *offlineBackend) Close() error {
+	if b.changed {
+		return b.local.Close()
+	}
+	return b.store.Close()
+}
+
+func printStatus(b backend, w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SPACE\tBASE POOLS\tFREE POOLS\tALLOCATED POOLS\tALLOCATED ADDRESSES\tSAVED")
+	for _, space := range b.Spaces() {
+		st, err := b.State(space)
+		if err != nil {
+			return err
+		}
+		addrs := 0
+		for _, a := range st.Addresses {
+			addrs += len(a)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\n", space, len(st.BasePools()), len(st.FreePools()), len(st.Allocated), addrs, st.Metadata.SavedAt.Format("2006-01-02 15:04:05"))
+	}
+	return tw.Flush()
+}
+
+func printPools(b backend, w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "POOL ID\tSTATE\tGATEWAY\tADDRESSES")
+	for _, space := range b.Spaces() {
+		st, err := b.State(space)
+		if err != nil {
+			return err
+		}
+		for _, pool := range st.Allocated {
+			_, p, err := net.ParseCIDR(pool)
+			if err != nil {
+				return err
+			}
+			id := driver.PoolID(space, st.ClassOf(pool), p)
+			fmt.Fprintf(tw, "%s\tallocated\t%s\t%s\n", id, st.Gateways[pool], strings.Join(st.Addresses[pool], ","))
+		}
+		for _, pool := range st.Free {
+			fmt.Fprintf(tw, "%s:%s\tfree\t\t\n", space, pool)
+		}
+		var classes []string
+		for class := range st.Classes {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			for _, pool := range st.Classes[class].Free {
+				fmt.Fprintf(tw, "%s/%s:%s\tfree\t\t\n", space, class, pool)
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+// releasePool releases a pool given by its pool ID, or by its subnet alone for the local address space.
+func releasePool(b backend, id string, w io.Writer) error {
+	if _, _, err := net.ParseCIDR(id); err == nil {
+		id = "local:" + id
+	}
+	space, pool, err := driver.ParsePoolID(id)
+	if err != nil {
+		return err
+	}
+	if err := b.ReleasePool(space, pool); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Released %s:%s\n", space, pool.String())
+	return nil
+}
+
+func exportState(b backend, args []string, w io.Writer) error {
+	st, err := b.State("local")
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if len(args) == 1 && args[0] != "-" {
+		return ioutil.WriteFile(args[0], data, 0644)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// importState replaces the saved local state. It never goes through the admin API, since the running driver would overwrite it.
+func importState(conf *Config, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	st := &allocator.State{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return fmt.Errorf("Failed to parse state file %s: %s", path, err)
+	}
+
+	store, err := conf.OpenStore()
+	if err != nil {
+		return fmt.Errorf("%s\nThe driver must be stopped to import state", err)
+	}
+	defer store.Close()
+	return allocator.ImportState(store, st)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/nategraf/mini-ipam-driver/allocator"
+)
+
+func TestPrintPoolsIDs(t *testing.T) {
+	store := allocator.NewMemoryStore()
+	a := allocator.NewLocalAllocator(store)
+	if _, err := a.ReconcileClasses(map[string][]*net.IPNet{
+		allocator.DefaultClass: {mustParseCIDR(t, "10.0.0.0/24")},
+		"ci":                   {mustParseCIDR(t, "10.1.0.0/24")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, class := range []string{allocator.DefaultClass, "ci"} {
+		if _, err := a.RequestPool(class, 28, false, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	b := &offlineBackend{allocators: map[string]allocator.Allocator{"local": a}, local: a, store: store}
+	if err := printPools(b, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	// Allocated pools are listed by the IDs the driver gives Docker, which include the class
+	for _, id := range []string{"local:10.0.0.0/28", "local/ci:10.1.0.0/28"} {
+		found := false
+		for _, line := range strings.Split(out.String(), "\n") {
+			if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == id && fields[1] == "allocated" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("no allocated pool listed with ID %s in:\n%s", id, out.String())
+		}
+	}
+}
+
+func mustParseCIDR(t *testing.T, str string) *net.IPNet {
+	t.Helper()
+	_, pool, err := net.ParseCIDR(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
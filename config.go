@@ -0,0 +1,447 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/nategraf/mini-ipam-driver/admin"
+	"github.com/nategraf/mini-ipam-driver/allocator"
+	"github.com/nategraf/mini-ipam-driver/driver"
+	"github.com/nategraf/mini-ipam-driver/engine"
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix starts the name of every environment variable read by the driver.
+const envPrefix = "MINI_IPAM_"
+
+// Config holds the driver settings which may be set in a config file, environment variables, or flags.
+// Later sources take precedence over earlier ones, in that order.
+type Config struct {
+	Pools        []string            `yaml:"pools"`
+	Classes      map[string][]string `yaml:"pool_classes"`
+	MaskLength   int                 `yaml:"mask_length"`
+	V6MaskLength int                 `yaml:"v6_mask_length"`
+	MinMaskLen   int                 `yaml:"min_mask_length"`
+	MaxMaskLen   int                 `yaml:"max_mask_length"`
+	V6MinMaskLen int                 `yaml:"v6_min_mask_length"`
+	V6MaxMaskLen int                 `yaml:"v6_max_mask_length"`
+	MaxPools     int                 `yaml:"max_pools_per_class"`
+	MaxAddresses int                 `yaml:"max_addresses"`
+	Socket       string              `yaml:"socket"`
+	Admin        string              `yaml:"admin"`
+	Metrics      string              `yaml:"metrics"`
+	StateDir     string              `yaml:"state_dir"`
+	Store        string              `yaml:"store"`
+	Gateway      string              `yaml:"gateway"`
+	Selection    string              `yaml:"pool_selection"`
+	Exclude      []string            `yaml:"exclude"`
+	Reserved     []string            `yaml:"reserved_offsets"`
+	AvoidHost    bool                `yaml:"avoid_host_networks"`
+	StickyAddrs  bool                `yaml:"sticky_addresses"`
+	GlobalStore  string              `yaml:"global_store"`
+	GlobalPools  []string            `yaml:"global_pools"`
+
+	DockerSocket    string `yaml:"docker_socket"`
+	DockerReconcile string `yaml:"docker_reconcile"`
+}
+
+// defaultConfig gives the config used when no other settings are provided.
+func defaultConfig() *Config {
+	conf := &Config{
+		MaskLength:   driver.DefaultMaskLength,
+		V6MaskLength: driver.DefaultV6MaskLength,
+		Socket:       defaultSocketAddress,
+		Admin:        admin.DefaultSocket,
+		StateDir:     allocator.DefaultStateDir,
+		Store:        "file",
+		Gateway:      allocator.GatewayFirst.String(),
+		Selection:    allocator.SelectBestFit.String(),
+
+		DockerSocket:    engine.DefaultSocket,
+		DockerReconcile: dockerReconcileOff,
+	}
+	for _, pool := range driver.DefaultPools {
+		conf.Pools = append(conf.Pools, pool.String())
+	}
+	return conf
+}
+
+// loadConfig builds the config from the defaults, config file, environment, and command line args.
+// The args left after the flags are returned.
+func loadConfig(name string, args []string) (*Config, []string, error) {
+	conf := defaultConfig()
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	file := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "YAML or JSON config `file` (env "+envPrefix+"CONFIG)")
+	pools := fs.String("pools", "", "comma separated list of base pools (env "+envPrefix+"POOLS)")
+	classes := fs.String("pool-classes", "", "comma separated list of class=pool pairs, such as ci=10.200.0.0/16 (env "+envPrefix+"POOL_CLASSES)")
+	masklen := fs.Int("mask-length", 0, "default IPv4 subnet mask length (env "+envPrefix+"MASK_LENGTH)")
+	v6masklen := fs.Int("v6-mask-length", 0, "default IPv6 subnet mask length (env "+envPrefix+"V6_MASK_LENGTH)")
+	minMasklen := fs.Int("min-mask-length", 0, "shortest IPv4 subnet mask length which may be requested, 0 for no limit (env "+envPrefix+"MIN_MASK_LENGTH)")
+	maxMasklen := fs.Int("max-mask-length", 0, "longest IPv4 subnet mask length which may be requested, 0 for no limit (env "+envPrefix+"MAX_MASK_LENGTH)")
+	v6MinMasklen := fs.Int("v6-min-mask-length", 0, "shortest IPv6 subnet mask length which may be requested, 0 for no limit (env "+envPrefix+"V6_MIN_MASK_LENGTH)")
+	v6MaxMasklen := fs.Int("v6-max-mask-length", 0, "longest IPv6 subnet mask length which may be requested, 0 for no limit (env "+envPrefix+"V6_MAX_MASK_LENGTH)")
+	maxPools := fs.Int("max-pools-per-class", 0, "most pools of each address family which may be allocated from each pool class, 0 for no limit (env "+envPrefix+"MAX_POOLS_PER_CLASS)")
+	maxAddrs := fs.Int("max-addresses", 0, "most addresses which may be in allocated IPv4 pools, 0 for no limit (env "+envPrefix+"MAX_ADDRESSES)")
+	socket := fs.String("socket", "", "plugin socket `path` (env "+envPrefix+"SOCKET)")
+	admin := fs.String("admin", "", "admin API Unix socket path or loopback `address`, empty to turn it off (env "+envPrefix+"ADMIN)")
+	metricsAddr := fs.String("metrics", "", "Prometheus metrics listen `address`, such as 127.0.0.1:9321 (env "+envPrefix+"METRICS)")
+	state := fs.String("state-dir", "", "allocator state `directory` (env "+envPrefix+"STATE_DIR)")
+	exclude := fs.String("exclude", "", "comma separated list of subnets which are never handed out (env "+envPrefix+"EXCLUDE)")
+	reserved := fs.String("reserved-offsets", "", "comma separated list of address offsets, such as 1-9, never assigned in new pools (env "+envPrefix+"RESERVED_OFFSETS)")
+	avoidHost := fs.Bool("avoid-host-networks", false, "do not choose subnets which overlap the host's routes or interfaces (env "+envPrefix+"AVOID_HOST_NETWORKS)")
+	stickyAddrs := fs.Bool("sticky-addresses", false, "give containers the address their MAC address had last time, if it is free (env "+envPrefix+"STICKY_ADDRESSES)")
+	store := fs.String("store", "", "allocator state store, \"file\", \"bolt\", or \"memory\" (env "+envPrefix+"STORE)")
+	gateway := fs.String("gateway", "", "gateway address of each pool, \"first\" or \"last\" (env "+envPrefix+"GATEWAY)")
+	selection := fs.String("pool-selection", "", "how free pools are chosen, \"best-fit\", \"lowest-address\", or \"keep-large-blocks\" (env "+envPrefix+"POOL_SELECTION)")
+	globalStore := fs.String("global-store", "", "global address space store `url`, such as consul://127.0.0.1:8500/mini-ipam (env "+envPrefix+"GLOBAL_STORE)")
+	dockerSocket := fs.String("docker-socket", "", "Docker Engine API socket `path` (env "+envPrefix+"DOCKER_SOCKET)")
+	dockerReconcile := fs.String("docker-reconcile", "", "reconcile with Docker networks on startup, \"off\", \"report\", \"adopt\", or \"prune\" (env "+envPrefix+"DOCKER_RECONCILE)")
+	globalPools := fs.String("global-pools", "", "comma separated list of global base pools (env "+envPrefix+"GLOBAL_POOLS)")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *file != "" {
+		data, err := ioutil.ReadFile(*file)
+		if err != nil {
+			return nil, nil, err
+		}
+		// YAML is a superset of JSON, so this handles both formats
+		if err := yaml.UnmarshalStrict(data, conf); err != nil {
+			return nil, nil, fmt.Errorf("Failed to parse config file %s: %s", *file, err)
+		}
+	}
+
+	if err := conf.loadEnv(); err != nil {
+		return nil, nil, err
+	}
+
+	// Only flags which were explicitly set override the other sources
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "pools":
+			conf.Pools = splitList(*pools)
+		case "pool-classes":
+			conf.Classes = parseClassList(*classes)
+		case "mask-length":
+			conf.MaskLength = *masklen
+		case "v6-mask-length":
+			conf.V6MaskLength = *v6masklen
+		case "min-mask-length":
+			conf.MinMaskLen = *minMasklen
+		case "max-mask-length":
+			conf.MaxMaskLen = *maxMasklen
+		case "v6-min-mask-length":
+			conf.V6MinMaskLen = *v6MinMasklen
+		case "v6-max-mask-length":
+			conf.V6MaxMaskLen = *v6MaxMasklen
+		case "max-pools-per-class":
+			conf.MaxPools = *maxPools
+		case "max-addresses":
+			conf.MaxAddresses = *maxAddrs
+		case "socket":
+			conf.Socket = *socket
+		case "admin":
+			conf.Admin = *admin
+		case "metrics":
+			conf.Metrics = *metricsAddr
+		case "state-dir":
+			conf.StateDir = *state
+		case "store":
+			conf.Store = *store
+		case "gateway":
+			conf.Gateway = *gateway
+		case "pool-selection":
+			conf.Selection = *selection
+		case "exclude":
+			conf.Exclude = splitList(*exclude)
+		case "reserved-offsets":
+			conf.Reserved = splitList(*reserved)
+		case "avoid-host-networks":
+			conf.AvoidHost = *avoidHost
+		case "sticky-addresses":
+			conf.StickyAddrs = *stickyAddrs
+		case "global-store":
+			conf.GlobalStore = *globalStore
+		case "global-pools":
+			conf.GlobalPools = splitList(*globalPools)
+		case "docker-socket":
+			conf.DockerSocket = *dockerSocket
+		case "docker-reconcile":
+			conf.DockerReconcile = *dockerReconcile
+		}
+	})
+
+	if _, err := conf.BasePools(); err != nil {
+		return nil, nil, err
+	}
+	if err := conf.checkLimits(); err != nil {
+		return nil, nil, err
+	}
+	if _, err := conf.ClassPools(); err != nil {
+		return nil, nil, err
+	}
+	if _, err := conf.GlobalBasePools(); err != nil {
+		return nil, nil, err
+	}
+	if _, err := conf.ExcludedPools(); err != nil {
+		return nil, nil, err
+	}
+	if _, err := conf.ReservedOffsets(); err != nil {
+		return nil, nil, err
+	}
+	if conf.GlobalStore != "" {
+		if _, _, err := allocator.ParseKVStore(conf.GlobalStore); err != nil {
+			return nil, nil, fmt.Errorf("Invalid global store %q: %s", conf.GlobalStore, err)
+		}
+	}
+	switch conf.Store {
+	case "file", "bolt", "memory":
+	default:
+		return nil, nil, fmt.Errorf("Unknown store type: %s", conf.Store)
+	}
+	if _, err := allocator.ParseGatewayPosition(conf.Gateway); err != nil {
+		return nil, nil, err
+	}
+	if _, err := allocator.ParseSelectionPolicy(conf.Selection); err != nil {
+		return nil, nil, err
+	}
+	switch conf.DockerReconcile {
+	case dockerReconcileOff, dockerReconcileReport, dockerReconcileAdopt, dockerReconcilePrune:
+	default:
+		return nil, nil, fmt.Errorf("Unknown Docker reconcile mode: %s", conf.DockerReconcile)
+	}
+	return conf, fs.Args(), nil
+}
+
+// checkLimits checks that the configured limits make sense together and with the default mask lengths.
+func (c *Config) checkLimits() error {
+	if c.MaxPools < 0 || c.MaxAddresses < 0 {
+		return fmt.Errorf("Limits must not be negative")
+	}
+	if err := checkMaskLimits("IPv4", c.MaskLength, c.MinMaskLen, c.MaxMaskLen, 8*net.IPv4len); err != nil {
+		return err
+	}
+	return checkMaskLimits("IPv6", c.V6MaskLength, c.V6MinMaskLen, c.V6MaxMaskLen, 8*net.IPv6len)
+}
+
+// checkMaskLimits checks the mask length bounds of one address family against each other and its default mask length.
+func checkMaskLimits(family string, masklen, min, max, bits int) error {
+	if masklen < 0 || masklen > bits {
+		return fmt.Errorf("Default %s mask length %d must be between 0 and %d", family, masklen, bits)
+	}
+	if min < 0 || max < 0 {
+		return fmt.Errorf("Limits must not be negative")
+	}
+	if min > bits || max > bits {
+		return fmt.Errorf("%s mask length limits must be at most %d", family, bits)
+	}
+	if min != 0 && max != 0 && min > max {
+		return fmt.Errorf("Minimum %s mask length %d is longer than the maximum %d", family, min, max)
+	}
+	if (min != 0 && masklen < min) || (max != 0 && masklen > max) {
+		return fmt.Errorf("Default %s mask length %d is outside of the allowed mask lengths", family, masklen)
+	}
+	return nil
+}
+
+// Limits gives the configured limits on allocations.
+func (c *Config) Limits() driver.Limits {
+	return driver.Limits{
+		MaxPoolsPerClass: c.MaxPools,
+		MaxAddresses:     uint64(c.MaxAddresses),
+		MinMaskLength:    c.MinMaskLen,
+		MaxMaskLength:    c.MaxMaskLen,
+		V6MinMaskLength:  c.V6MinMaskLen,
+		V6MaxMaskLength:  c.V6MaxMaskLen,
+	}
+}
+
+// loadEnv overrides config values with any environment variables which are set.
+func (c *Config) loadEnv() error {
+	if val, ok := os.LookupEnv(envPrefix + "POOLS"); ok {
+		c.Pools = splitList(val)
+	}
+	if val, ok := os.LookupEnv(envPrefix + "POOL_CLASSES"); ok {
+		c.Classes = parseClassList(val)
+	}
+	ints := map[string]*int{
+		"MASK_LENGTH":         &c.MaskLength,
+		"V6_MASK_LENGTH":      &c.V6MaskLength,
+		"MIN_MASK_LENGTH":     &c.MinMaskLen,
+		"MAX_MASK_LENGTH":     &c.MaxMaskLen,
+		"V6_MIN_MASK_LENGTH":  &c.V6MinMaskLen,
+		"V6_MAX_MASK_LENGTH":  &c.V6MaxMaskLen,
+		"MAX_POOLS_PER_CLASS": &c.MaxPools,
+		"MAX_ADDRESSES":       &c.MaxAddresses,
+	}
+	for name, dst := range ints {
+		if val, ok := os.LookupEnv(envPrefix + name); ok {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("Invalid value for %s%s: %s", envPrefix, name, val)
+			}
+			*dst = n
+		}
+	}
+	if val, ok := os.LookupEnv(envPrefix + "SOCKET"); ok {
+		c.Socket = val
+	}
+	if val, ok := os.LookupEnv(envPrefix + "ADMIN"); ok {
+		c.Admin = val
+	}
+	if val, ok := os.LookupEnv(envPrefix + "METRICS"); ok {
+		c.Metrics = val
+	}
+	if val, ok := os.LookupEnv(envPrefix + "STATE_DIR"); ok {
+		c.StateDir = val
+	}
+	if val, ok := os.LookupEnv(envPrefix + "STORE"); ok {
+		c.Store = val
+	}
+	if val, ok := os.LookupEnv(envPrefix + "GATEWAY"); ok {
+		c.Gateway = val
+	}
+	if val, ok := os.LookupEnv(envPrefix + "POOL_SELECTION"); ok {
+		c.Selection = val
+	}
+	if val, ok := os.LookupEnv(envPrefix + "EXCLUDE"); ok {
+		c.Exclude = splitList(val)
+	}
+	if val, ok := os.LookupEnv(envPrefix + "RESERVED_OFFSETS"); ok {
+		c.Reserved = splitList(val)
+	}
+	if val, ok := os.LookupEnv(envPrefix + "AVOID_HOST_NETWORKS"); ok {
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %sAVOID_HOST_NETWORKS: %s", envPrefix, val)
+		}
+		c.AvoidHost = b
+	}
+	if val, ok := os.LookupEnv(envPrefix + "STICKY_ADDRESSES"); ok {
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %sSTICKY_ADDRESSES: %s", envPrefix, val)
+		}
+		c.StickyAddrs = b
+	}
+	if val, ok := os.LookupEnv(envPrefix + "GLOBAL_STORE"); ok {
+		c.GlobalStore = val
+	}
+	if val, ok := os.LookupEnv(envPrefix + "GLOBAL_POOLS"); ok {
+		c.GlobalPools = splitList(val)
+	}
+	if val, ok := os.LookupEnv(envPrefix + "DOCKER_SOCKET"); ok {
+		c.DockerSocket = val
+	}
+	if val, ok := os.LookupEnv(envPrefix + "DOCKER_RECONCILE"); ok {
+		c.DockerReconcile = val
+	}
+	return nil
+}
+
+// BasePools parses the configured base pools.
+func (c *Config) BasePools() ([]*net.IPNet, error) {
+	return parseCIDRs(c.Pools)
+}
+
+// ClassPools parses the configured base pools of every pool class, including the default class.
+func (c *Config) ClassPools() (map[string][]*net.IPNet, error) {
+	pools, err := c.BasePools()
+	if err != nil {
+		return nil, err
+	}
+	res := map[string][]*net.IPNet{allocator.DefaultClass: pools}
+	for name, strs := range c.Classes {
+		if name == allocator.DefaultClass || !allocator.ValidClassName(name) {
+			return nil, fmt.Errorf("Invalid pool class name: %q", name)
+		}
+		if res[name], err = parseCIDRs(strs); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// GlobalBasePools parses the configured base pools of the global address space.
+func (c *Config) GlobalBasePools() ([]*net.IPNet, error) {
+	return parseCIDRs(c.GlobalPools)
+}
+
+// ExcludedPools parses the configured excluded subnets.
+func (c *Config) ExcludedPools() ([]*net.IPNet, error) {
+	return parseCIDRs(c.Exclude)
+}
+
+// ReservedOffsets parses the configured reserved address offset ranges.
+func (c *Config) ReservedOffsets() ([]allocator.OffsetRange, error) {
+	var res []allocator.OffsetRange
+	for _, str := range c.Reserved {
+		r, err := allocator.ParseOffsetRange(str)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// parseCIDRs parses a list of pools in CIDR notation.
+func parseCIDRs(strs []string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+	for _, str := range strs {
+		_, pool, err := net.ParseCIDR(str)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pool %q: %s", str, err)
+		}
+		res = append(res, pool)
+	}
+	return res, nil
+}
+
+// parseClassList parses a comma separated list of class=pool pairs into the pools of each class.
+// Entries without a class name are kept under an empty name, so they fail validation.
+func parseClassList(str string) map[string][]string {
+	res := make(map[string][]string)
+	for _, entry := range splitList(str) {
+		name, pool := "", entry
+		if i := strings.Index(entry, "="); i >= 0 {
+			name, pool = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+		}
+		res[name] = append(res[name], pool)
+	}
+	return res
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(str string) []string {
+	var res []string
+	for _, s := range strings.Split(str, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// OpenStore opens the configured allocator state store.
+func (c *Config) OpenStore() (allocator.Store, error) {
+	switch c.Store {
+	case "bolt":
+		if err := os.MkdirAll(c.StateDir, 0755); err != nil {
+			return nil, err
+		}
+		return allocator.NewBoltStore(filepath.Join(c.StateDir, "state.db"))
+	case "memory":
+		return allocator.NewMemoryStore(), nil
+	default:
+		return allocator.NewFileStore(c.StateDir)
+	}
+}
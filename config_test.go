@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(c *Config)
+		wantErr bool
+	}{
+		{name: "defaults", set: func(c *Config) {}},
+		{name: "shortest mask", set: func(c *Config) { c.MaskLength = 0 }},
+		{name: "longest mask", set: func(c *Config) { c.MaskLength = 32 }},
+		{name: "negative mask", set: func(c *Config) { c.MaskLength = -1 }, wantErr: true},
+		{name: "mask too long", set: func(c *Config) { c.MaskLength = 33 }, wantErr: true},
+		{name: "shortest IPv6 mask", set: func(c *Config) { c.V6MaskLength = 0 }},
+		{name: "longest IPv6 mask", set: func(c *Config) { c.V6MaskLength = 128 }},
+		{name: "negative IPv6 mask", set: func(c *Config) { c.V6MaskLength = -1 }, wantErr: true},
+		{name: "IPv6 mask too long", set: func(c *Config) { c.V6MaskLength = 129 }, wantErr: true},
+		{name: "mask limits", set: func(c *Config) { c.MinMaskLen, c.MaxMaskLen = 16, 32 }},
+		{name: "mask limit too long", set: func(c *Config) { c.MaxMaskLen = 33 }, wantErr: true},
+		{name: "IPv6 mask limit too long", set: func(c *Config) { c.V6MaxMaskLen = 129 }, wantErr: true},
+		{name: "negative limit", set: func(c *Config) { c.MinMaskLen = -1 }, wantErr: true},
+		{name: "crossed limits", set: func(c *Config) { c.MinMaskLen, c.MaxMaskLen = 28, 24 }, wantErr: true},
+		{name: "mask outside limits", set: func(c *Config) { c.MinMaskLen, c.MaxMaskLen = 16, 24 }, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := defaultConfig()
+			test.set(c)
+			err := c.checkLimits()
+			if test.wantErr && err == nil {
+				t.Error("limits were accepted, want an error")
+			} else if !test.wantErr && err != nil {
+				t.Errorf("limits were refused: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/nategraf/mini-ipam-driver/allocator"
+	"github.com/nategraf/mini-ipam-driver/engine"
+	"github.com/sirupsen/logrus"
+)
+
+// Modes of reconciling the allocator with the networks Docker is using
+const (
+	dockerReconcileOff    = "off"
+	dockerReconcileReport = "report"
+	dockerReconcileAdopt  = "adopt"
+	dockerReconcilePrune  = "prune"
+)
+
+// reconcileDocker compares the local allocator to the networks Docker has created with this driver, reporting any drift.
+// Depending on the mode, pools and addresses in use are then adopted, and stale ones released.
+func reconcileDocker(conf *Config, a *allocator.LocalAllocator) {
+	if conf.DockerReconcile == dockerReconcileOff {
+		return
+	}
+
+	// Docker names the driver after its socket
+	name := strings.TrimSuffix(filepath.Base(conf.Socket), filepath.Ext(conf.Socket))
+
+	networks, err := engine.NewClient(conf.DockerSocket).Networks(name)
+	if err != nil {
+		logrus.Warnf("Failed to list Docker networks, skipping reconciliation: %s", err)
+		return
+	}
+
+	drift := a.DiffAllocations(dockerAllocations(networks))
+	for _, missing := range drift.MissingPools {
+		logrus.Warnf("Pool is used by a Docker network but is free: %s", missing.Pool.String())
+	}
+	for _, missing := range drift.MissingAddresses {
+		for _, ip := range append([]net.IP{missing.Gateway}, missing.Addresses...) {
+			if ip != nil {
+				logrus.Warnf("Address is used by Docker but is free: %s in pool %s", ip.String(), missing.Pool.String())
+			}
+		}
+	}
+	for _, pool := range drift.StalePools {
+		logrus.Warnf("Pool is allocated but not used by any Docker network: %s", pool.String())
+	}
+	for _, stale := range drift.StaleAddresses {
+		for _, ip := range stale.Addresses {
+			logrus.Warnf("Address is allocated but not used by Docker: %s in pool %s", ip.String(), stale.Pool.String())
+		}
+	}
+	for _, pool := range drift.Conflicts {
+		logrus.Errorf("Pool is used by a Docker network but conflicts with a different allocated pool: %s", pool.String())
+	}
+	for _, pool := range drift.Unmanaged {
+		logrus.Warnf("Pool is used by a Docker network but is outside of the configured pools: %s", pool.String())
+	}
+	if drift.Empty() {
+		logrus.Infof("Allocator state matches %d Docker networks", len(networks))
+	}
+
+	if conf.DockerReconcile == dockerReconcileReport {
+		return
+	}
+	if err := a.ApplyDrift(drift, conf.DockerReconcile == dockerReconcilePrune); err != nil {
+		logrus.Errorf("Failed to correct allocator state: %s", err)
+	}
+	for _, rejected := range drift.Rejected {
+		for _, ip := range append([]net.IP{rejected.Gateway}, rejected.Addresses...) {
+			if ip != nil {
+				logrus.Errorf("Address is used by Docker but cannot be allocated: %s in pool %s", ip.String(), rejected.Pool.String())
+			}
+		}
+	}
+}
+
+// dockerAllocations gives the pools and addresses used by local Docker networks.
+// Networks with a global scope are allocated from the global address space, so they are skipped.
+func dockerAllocations(networks []*engine.Network) []*allocator.Allocation {
+	var res []*allocator.Allocation
+	for _, n := range networks {
+		if n.Scope != "" && n.Scope != "local" {
+			continue
+		}
+
+		var allocs []*allocator.Allocation
+		for _, conf := range n.IPAM.Config {
+			_, pool, err := net.ParseCIDR(conf.Subnet)
+			if err != nil {
+				logrus.Warnf("Docker network %s has an invalid subnet: %s", n.Name, conf.Subnet)
+				continue
+			}
+			alloc := &allocator.Allocation{Pool: pool, Gateway: net.ParseIP(conf.Gateway)}
+
+			// Auxiliary addresses are requested from the driver like container addresses, and held until the network is removed
+			for host, str := range conf.AuxiliaryAddresses {
+				ip := net.ParseIP(str)
+				if ip == nil || !pool.Contains(ip) {
+					logrus.Warnf("Docker network %s has an invalid auxiliary address for %s: %s", n.Name, host, str)
+					continue
+				}
+				alloc.Addresses = append(alloc.Addresses, ip)
+			}
+			allocs = append(allocs, alloc)
+		}
+
+		for _, c := range n.Containers {
+			for _, str := range []string{c.IPv4Address, c.IPv6Address} {
+				ip, _, err := net.ParseCIDR(str)
+				if err != nil {
+					continue
+				}
+				for _, alloc := range allocs {
+					if alloc.Pool.Contains(ip) {
+						alloc.Addresses = append(alloc.Addresses, ip)
+						break
+					}
+				}
+			}
+		}
+		res = append(res, allocs...)
+	}
+	return res
+}
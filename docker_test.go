@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/nategraf/mini-ipam-driver/allocator"
+	"github.com/nategraf/mini-ipam-driver/engine"
+)
+
+// fakeEngine serves the network endpoints of the Docker Engine API on a Unix socket, and gives the socket path.
+func fakeEngine(t *testing.T, networks []*engine.Network) string {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/networks", func(w http.ResponseWriter, r *http.Request) {
+		// The list endpoint leaves out the containers
+		var list []engine.Network
+		for _, n := range networks {
+			summary := *n
+			summary.Containers = nil
+			list = append(list, summary)
+		}
+		json.NewEncoder(w).Encode(list)
+	})
+	mux.HandleFunc("/networks/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/networks/")
+		for _, n := range networks {
+			if n.ID == id {
+				json.NewEncoder(w).Encode(n)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return socket
+}
+
+func TestReconcileDocker(t *testing.T) {
+	networks := []*engine.Network{
+		{
+			ID: "web", Name: "web", Scope: "local", Driver: "bridge",
+			IPAM: engine.IPAM{Driver: "mini", Config: []engine.IPAMConfig{{
+				Subnet:             "10.0.0.0/28",
+				Gateway:            "10.0.0.1",
+				AuxiliaryAddresses: map[string]string{"router": "10.0.0.5"},
+			}}},
+			Containers: map[string]engine.NetworkEndpoint{
+				"c1": {Name: "app", IPv4Address: "10.0.0.2/28"},
+			},
+		},
+		{
+			// Created while the driver lost its state, so the allocator has the subnet free
+			ID: "db", Name: "db", Scope: "local", Driver: "bridge",
+			IPAM: engine.IPAM{Driver: "mini", Config: []engine.IPAMConfig{{Subnet: "10.0.0.32/28", Gateway: "10.0.0.33"}}},
+			Containers: map[string]engine.NetworkEndpoint{
+				"c2": {Name: "postgres", IPv4Address: "10.0.0.34/28"},
+			},
+		},
+		{
+			ID: "other", Name: "other", Scope: "local", Driver: "bridge",
+			IPAM: engine.IPAM{Driver: "default", Config: []engine.IPAMConfig{{Subnet: "10.0.0.64/28"}}},
+		},
+	}
+
+	tests := []struct {
+		mode string
+		want map[string][]string // Allocated addresses, including gateways, keyed by allocated pool
+	}{
+		{dockerReconcileOff, map[string][]string{
+			"10.0.0.0/28":  {"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.5"},
+			"10.0.0.16/28": nil,
+		}},
+		{dockerReconcileReport, map[string][]string{
+			"10.0.0.0/28":  {"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.5"},
+			"10.0.0.16/28": nil,
+		}},
+		{dockerReconcileAdopt, map[string][]string{
+			"10.0.0.0/28":  {"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.5"},
+			"10.0.0.16/28": nil,
+			"10.0.0.32/28": {"10.0.0.33", "10.0.0.34"},
+		}},
+		{dockerReconcilePrune, map[string][]string{
+			"10.0.0.0/28":  {"10.0.0.1", "10.0.0.2", "10.0.0.5"},
+			"10.0.0.32/28": {"10.0.0.33", "10.0.0.34"},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			a := allocator.NewLocalAllocator(allocator.NewMemoryStore())
+			_, base, _ := net.ParseCIDR("10.0.0.0/24")
+			if err := a.AddPool(base); err != nil {
+				t.Fatal(err)
+			}
+
+			// web is allocated, with a stale address left over from a container which is gone
+			web, err := a.RequestPool(allocator.DefaultClass, 28, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.RequestGateway(web, nil); err != nil {
+				t.Fatal(err)
+			}
+			for _, ip := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.5"} {
+				if _, err := a.RequestAddress(web, nil, net.ParseIP(ip)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// A network which Docker no longer has
+			if _, err := a.RequestPool(allocator.DefaultClass, 28, false, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			conf := defaultConfig()
+			conf.DockerSocket = fakeEngine(t, networks)
+			conf.DockerReconcile = test.mode
+			reconcileDocker(conf, a)
+
+			st, err := a.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string][]string)
+			for _, pool := range st.Allocated {
+				addrs := append([]string(nil), st.Addresses[pool]...)
+				sort.Strings(addrs)
+				got[pool] = addrs
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("allocated after %s reconcile:\n got %v\nwant %v", test.mode, got, test.want)
+			}
+		})
+	}
+}
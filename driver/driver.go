@@ -6,6 +6,8 @@ import (
 	"reflect"
 	"regexp"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/ipam"
 	"github.com/docker/libnetwork/types"
@@ -17,15 +19,33 @@ var (
 	// DefaultPools are the IP blocks used when no others are provided.
 	DefaultPools = parsePools([]string{"172.16.0.0/16"})
 
-	poolIdRe = regexp.MustCompile("([a-zA-Z0-9_]+):([a-zA-Z0-9./]+)")
+	poolIdRe = regexp.MustCompile("^([a-zA-Z0-9_]+)(?:/([a-zA-Z0-9_-]+))?:([a-zA-Z0-9.:/]+)(?:,([a-zA-Z0-9.:/]+))?$")
 )
 
-// DefaultMaskLength specifies the CIDR mask length to use if one is not specified.
-const DefaultMaskLength = 28
+const (
+	// DefaultMaskLength specifies the CIDR mask length to use if one is not specified.
+	DefaultMaskLength = 28
+
+	// DefaultV6MaskLength specifies the CIDR mask length to use for IPv6 if one is not specified.
+	DefaultV6MaskLength = 64
+)
 
 type Driver struct {
 	Local  allocator.Allocator
 	Global allocator.Allocator
+
+	// MaskLength and V6MaskLength override DefaultMaskLength and DefaultV6MaskLength when non-zero.
+	MaskLength   int
+	V6MaskLength int
+
+	// Limits bound the pools which may be requested.
+	Limits Limits
+
+	// StickyAddresses asks Docker for the MAC address of each endpoint, so the same MAC gets the same address back.
+	StickyAddresses bool
+
+	// limitLock makes checking the limits and allocating a pool atomic, so concurrent requests cannot exceed them.
+	limitLock sync.Mutex
 }
 
 // unwrap gives the pointed to value if the i is an non-nil pointer.
@@ -36,8 +56,13 @@ func unwrap(i interface{}) interface{} {
 	return i
 }
 
-// logRequest logs request inputs and results.
-func logRequest(fname string, req interface{}, res interface{}, err error) {
+// logRequest logs request inputs and results, and records the request in the driver metrics.
+// start is when the request was received.
+func logRequest(fname string, start time.Time, req interface{}, res interface{}, err error) {
+	class := errorClass(err)
+	requestsTotal.WithLabelValues(fname, class).Inc()
+	requestDuration.WithLabelValues(fname, class).Observe(time.Since(start).Seconds())
+
 	req, res = unwrap(req), unwrap(res)
 	if err == nil {
 		if res == nil {
@@ -47,28 +72,42 @@ func logRequest(fname string, req interface{}, res interface{}, err error) {
 		}
 		return
 	}
+	switch class {
+	case "MaskableError", "RetryError":
+		logrus.WithError(err).Infof("[%s] %s(%v): %v", class, fname, req, err)
+	case "BadRequestError", "NotFoundError", "ForbiddenError", "NoServiceError", "NotImplementedError":
+		logrus.WithError(err).Warnf("[%s] %s(%v): %v", class, fname, req, err)
+	default:
+		// Timeouts, internal errors, and unclassified errors should be treated as bad.
+		logrus.WithError(err).Errorf("[%s] %s(%v): %v", class, fname, req, err)
+	}
+}
+
+// errorClass names the libnetwork error type implemented by err, "none" if err is nil, or "UNKNOWN" if it has no type.
+func errorClass(err error) string {
 	switch err.(type) {
+	case nil:
+		return "none"
 	case types.MaskableError:
-		logrus.WithError(err).Infof("[MaskableError] %s(%v): %v", fname, req, err)
+		return "MaskableError"
 	case types.RetryError:
-		logrus.WithError(err).Infof("[RetryError] %s(%v): %v", fname, req, err)
+		return "RetryError"
 	case types.BadRequestError:
-		logrus.WithError(err).Warnf("[BadRequestError] %s(%v): %v", fname, req, err)
+		return "BadRequestError"
 	case types.NotFoundError:
-		logrus.WithError(err).Warnf("[NotFoundError] %s(%v): %v", fname, req, err)
+		return "NotFoundError"
 	case types.ForbiddenError:
-		logrus.WithError(err).Warnf("[ForbiddenError] %s(%v): %v", fname, req, err)
+		return "ForbiddenError"
 	case types.NoServiceError:
-		logrus.WithError(err).Warnf("[NoServiceError] %s(%v): %v", fname, req, err)
+		return "NoServiceError"
 	case types.NotImplementedError:
-		logrus.WithError(err).Warnf("[NotImplementedError] %s(%v): %v", fname, req, err)
+		return "NotImplementedError"
 	case types.TimeoutError:
-		logrus.WithError(err).Errorf("[TimeoutError] %s(%v): %v", fname, req, err)
+		return "TimeoutError"
 	case types.InternalError:
-		logrus.WithError(err).Errorf("[InternalError] %s(%v): %v", fname, req, err)
+		return "InternalError"
 	default:
-		// Unclassified errors should be treated as bad.
-		logrus.WithError(err).Errorf("[UNKNOWN] %s(%v): %v", fname, req, err)
+		return "UNKNOWN"
 	}
 }
 
@@ -83,24 +122,58 @@ func parsePools(strs []string) []*net.IPNet {
 	return res
 }
 
-func poolToId(as string, pool *net.IPNet) string {
-	return fmt.Sprintf("%s:%s", as, pool.String())
+// poolToId encodes the address space, pool class, pool, and optional sub-pool into a pool ID.
+// The class is left out if it is the default class, so such IDs look like local:172.16.0.0/28.
+func poolToId(as, class string, pool, subpool *net.IPNet) string {
+	if class != "" && class != allocator.DefaultClass {
+		as = as + "/" + class
+	}
+	if subpool == nil {
+		return fmt.Sprintf("%s:%s", as, pool.String())
+	}
+	return fmt.Sprintf("%s:%s,%s", as, pool.String(), subpool.String())
 }
 
-func idToPool(id string) (string, *net.IPNet) {
+// idToPool decodes a pool ID created by poolToId. The sub-pool is nil if none was encoded.
+func idToPool(id string) (string, string, *net.IPNet, *net.IPNet) {
 	m := poolIdRe.FindStringSubmatch(id)
 
 	if len(m) == 0 {
-		return "", nil
+		return "", "", nil, nil
 	}
 
-	as := m[1]
-	_, pool, err := net.ParseCIDR(m[2])
+	as, class := m[1], m[2]
+	if class == "" {
+		class = allocator.DefaultClass
+	}
+	_, pool, err := net.ParseCIDR(m[3])
 	if err != nil {
-		return "", nil
+		return "", "", nil, nil
 	}
 
-	return as, pool
+	var subpool *net.IPNet
+	if m[4] != "" {
+		_, subpool, err = net.ParseCIDR(m[4])
+		if err != nil {
+			return "", "", nil, nil
+		}
+	}
+
+	return as, class, pool, subpool
+}
+
+// ParsePoolID decodes the address space and pool of a pool ID handed to Docker, such as local:172.16.0.0/28.
+func ParsePoolID(id string) (string, *net.IPNet, error) {
+	as, _, pool, _ := idToPool(id)
+	if pool == nil {
+		return "", nil, fmt.Errorf("Invalid pool ID: %s", id)
+	}
+	return as, pool, nil
+}
+
+// PoolID encodes the address space, pool class, and pool into the pool ID the driver hands to Docker for them.
+func PoolID(as, class string, pool *net.IPNet) string {
+	return poolToId(as, class, pool, nil)
 }
 
 func (d *Driver) asToAllocator(as string) (allocator.Allocator, error) {
@@ -117,20 +190,17 @@ func (d *Driver) asToAllocator(as string) (allocator.Allocator, error) {
 }
 
 func (d *Driver) GetDefaultAddressSpaces() (res *ipam.AddressSpacesResponse, err error) {
-	defer func() { logRequest("GetDefaultAddressSpaces", nil, res, err) }()
+	defer func(start time.Time) { logRequest("GetDefaultAddressSpaces", start, nil, res, err) }(time.Now())
 
-	res = &ipam.AddressSpacesResponse{allocator.AddrSpace(d.Local), allocator.AddrSpace(d.Global)}
+	res = &ipam.AddressSpacesResponse{LocalDefaultAddressSpace: allocator.AddrSpace(d.Local), GlobalDefaultAddressSpace: allocator.AddrSpace(d.Global)}
 	return res, nil
 }
 
 func (d *Driver) RequestPool(req *ipam.RequestPoolRequest) (res *ipam.RequestPoolResponse, err error) {
-	defer func() { logRequest("RequestPool", req, res, err) }()
+	defer func(start time.Time) { logRequest("RequestPool", start, req, res, err) }(time.Now())
 
-	if req.V6 {
-		return nil, ErrUnsupportedIPv6{}
-	}
-	if req.Pool != "" || req.SubPool != "" {
-		return nil, ErrUnsupportedPoolReq{}
+	if req.SubPool != "" && req.Pool == "" {
+		return nil, ErrInvalidSubPool(req.SubPool)
 	}
 
 	a, err := d.asToAllocator(req.AddressSpace)
@@ -138,30 +208,91 @@ func (d *Driver) RequestPool(req *ipam.RequestPoolRequest) (res *ipam.RequestPoo
 		return nil, err
 	}
 
-	val, found := req.Options[CidrMaskLength]
-	var masklen int
+	option, masklen := CidrMaskLength, DefaultMaskLength
+	if req.V6 {
+		option, masklen = CidrV6MaskLength, DefaultV6MaskLength
+		if d.V6MaskLength != 0 {
+			masklen = d.V6MaskLength
+		}
+	} else if d.MaskLength != 0 {
+		masklen = d.MaskLength
+	}
+
+	val, found := req.Options[option]
 	if found {
 		masklen, err = strconv.Atoi(val)
 		if err != nil {
-			return nil, err
+			return nil, ErrInvalidRequest(fmt.Sprintf("%s must be an integer: %s", option, val))
 		}
-	} else {
-		masklen = DefaultMaskLength
 	}
 
-	pool, err := a.RequestPool(masklen, nil)
+	// The class and sticky key only matter when the allocator chooses the subnet
+	class, key := allocator.DefaultClass, ""
+	if val, found := req.Options[PoolClass]; found && req.Pool == "" {
+		if !allocator.ValidClassName(val) {
+			return nil, ErrInvalidPoolClass(val)
+		}
+		class = val
+	}
+	if req.Pool == "" {
+		key = req.Options[StickyKey]
+	}
+
+	var pool *net.IPNet
+	if req.Pool != "" {
+		_, pool, err = net.ParseCIDR(req.Pool)
+		if err != nil {
+			return nil, ErrParsePool(req.Pool)
+		}
+	}
+
+	var subpool *net.IPNet
+	if req.SubPool != "" {
+		var ip net.IP
+		ip, subpool, err = net.ParseCIDR(req.SubPool)
+		if err != nil {
+			return nil, ErrParsePool(req.SubPool)
+		}
+
+		// The sub-pool must lie entirely within the pool
+		poolLen, _ := pool.Mask.Size()
+		subLen, _ := subpool.Mask.Size()
+		if !pool.Contains(ip) || subLen < poolLen {
+			return nil, ErrInvalidSubPool(req.SubPool)
+		}
+	}
+
+	if pool != nil {
+		masklen, _ = pool.Mask.Size()
+	}
+	if err := d.Limits.checkMaskLength(masklen, req.V6); err != nil {
+		return nil, err
+	}
+
+	d.limitLock.Lock()
+	defer d.limitLock.Unlock()
+
+	if err := d.Limits.checkUsage(a, class, masklen, req.V6, pool); err != nil {
+		return nil, err
+	}
+
+	if key != "" {
+		pool, err = a.RequestStickyPool(key, class, masklen, req.V6)
+	} else {
+		pool, err = a.RequestPool(class, masklen, req.V6, pool)
+	}
 	if err != nil {
-		return nil, types.InternalErrorf("Allocation failed: %s", err)
+		return nil, allocatorError("Allocation", err)
 	}
 
-	res = &ipam.RequestPoolResponse{poolToId(req.AddressSpace, pool), pool.String(), nil}
+	res = &ipam.RequestPoolResponse{PoolID: poolToId(req.AddressSpace, class, pool, subpool), Pool: pool.String()}
 	return res, nil
 }
 
 func (d *Driver) ReleasePool(req *ipam.ReleasePoolRequest) (err error) {
-	defer func() { logRequest("ReleasePool", req, nil, err) }()
+	defer func(start time.Time) { logRequest("ReleasePool", start, req, nil, err) }(time.Now())
 
-	as, pool := idToPool(req.PoolID)
+	as, _, pool, _ := idToPool(req.PoolID)
 	if pool == nil {
 		return ErrParseID(req.PoolID)
 	}
@@ -173,16 +304,16 @@ func (d *Driver) ReleasePool(req *ipam.ReleasePoolRequest) (err error) {
 
 	err = a.ReleasePool(pool)
 	if err != nil {
-		return types.InternalErrorf("Release failed: %s", err)
+		return allocatorError("Release", err)
 	}
 
 	return nil
 }
 
 func (d *Driver) RequestAddress(req *ipam.RequestAddressRequest) (res *ipam.RequestAddressResponse, err error) {
-	defer func() { logRequest("RequestAddress", req, res, err) }()
+	defer func(start time.Time) { logRequest("RequestAddress", start, req, res, err) }(time.Now())
 
-	as, pool := idToPool(req.PoolID)
+	as, _, pool, subpool := idToPool(req.PoolID)
 	if pool == nil {
 		return nil, ErrParseID(req.PoolID)
 	}
@@ -202,21 +333,28 @@ func (d *Driver) RequestAddress(req *ipam.RequestAddressRequest) (res *ipam.Requ
 		ip = nil
 	}
 
-	ip, err = a.RequestAddress(pool, ip)
+	mac := req.Options[MacAddress]
+	if req.Options[RequestAddressType] == GatewayAddressType {
+		ip, err = a.RequestGateway(pool, ip)
+	} else if d.StickyAddresses && ip == nil && mac != "" {
+		ip, err = a.RequestStickyAddress(pool, subpool, mac)
+	} else {
+		ip, err = a.RequestAddress(pool, subpool, ip)
+	}
 	if err != nil {
-		return nil, types.InternalErrorf("Allocation failed: %s", err)
+		return nil, allocatorError("Allocation", err)
 	}
 
 	pool.IP = ip
 
-	res = &ipam.RequestAddressResponse{pool.String(), nil}
+	res = &ipam.RequestAddressResponse{Address: pool.String()}
 	return res, nil
 }
 
 func (d *Driver) ReleaseAddress(req *ipam.ReleaseAddressRequest) (err error) {
-	defer func() { logRequest("ReleaseAddress", req, nil, err) }()
+	defer func(start time.Time) { logRequest("ReleaseAddress", start, req, nil, err) }(time.Now())
 
-	as, pool := idToPool(req.PoolID)
+	as, _, pool, _ := idToPool(req.PoolID)
 	if pool == nil {
 		return ErrParseID(req.PoolID)
 	}
@@ -230,16 +368,16 @@ func (d *Driver) ReleaseAddress(req *ipam.ReleaseAddressRequest) (err error) {
 	if ip == nil {
 		return ErrParseIP(req.Address)
 	}
-	err = a.ReleaseAddress(ip)
+	err = a.ReleaseAddress(pool, ip)
 	if err != nil {
-		return types.InternalErrorf("Release failed: %s", err)
+		return allocatorError("Release", err)
 	}
 	return nil
 }
 
 func (d *Driver) GetCapabilities() (res *ipam.CapabilitiesResponse, err error) {
-	defer func() { logRequest("GetCapabilities", nil, res, err) }()
+	defer func(start time.Time) { logRequest("GetCapabilities", start, nil, res, err) }(time.Now())
 
-	res = &ipam.CapabilitiesResponse{RequiresMACAddress: false}
+	res = &ipam.CapabilitiesResponse{RequiresMACAddress: d.StickyAddresses}
 	return res, nil
 }
@@ -0,0 +1,102 @@
+package driver
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/docker/libnetwork/types"
+	"github.com/nategraf/mini-ipam-driver/allocator"
+)
+
+func TestPoolID(t *testing.T) {
+	tests := []struct {
+		id      string
+		as      string
+		class   string
+		pool    string
+		subpool string
+	}{
+		{id: "local:172.16.0.0/28", as: "local", class: allocator.DefaultClass, pool: "172.16.0.0/28"},
+		{id: "local/ci:10.1.0.0/24", as: "local", class: "ci", pool: "10.1.0.0/24"},
+		{id: "global/build-2:10.1.0.0/24", as: "global", class: "build-2", pool: "10.1.0.0/24"},
+		{id: "local:172.16.0.0/24,172.16.0.128/25", as: "local", class: allocator.DefaultClass, pool: "172.16.0.0/24", subpool: "172.16.0.128/25"},
+		{id: "local/ci:10.1.0.0/24,10.1.0.0/26", as: "local", class: "ci", pool: "10.1.0.0/24", subpool: "10.1.0.0/26"},
+		{id: "local:fd00::/64", as: "local", class: allocator.DefaultClass, pool: "fd00::/64"},
+		{id: "local/ci:fd00:1::/64,fd00:1::/80", as: "local", class: "ci", pool: "fd00:1::/64", subpool: "fd00:1::/80"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.id, func(t *testing.T) {
+			as, class, pool, subpool := idToPool(test.id)
+			if pool == nil {
+				t.Fatalf("could not decode pool ID %s", test.id)
+			}
+			if as != test.as || class != test.class || pool.String() != test.pool {
+				t.Errorf("decoded %s, %s, %s, want %s, %s, %s", as, class, pool, test.as, test.class, test.pool)
+			}
+			if got := ipnetString(subpool); got != test.subpool {
+				t.Errorf("decoded sub-pool %q, want %q", got, test.subpool)
+			}
+			if id := poolToId(as, class, pool, subpool); id != test.id {
+				t.Errorf("encoded %s again as %s", test.id, id)
+			}
+		})
+	}
+}
+
+func TestPoolIDInvalid(t *testing.T) {
+	for _, id := range []string{
+		"",
+		"local",
+		"172.16.0.0/28",
+		"local:172.16.0.0",
+		"local:172.16.0.0/33",
+		"local/:172.16.0.0/28",
+		"local/ci/qa:172.16.0.0/28",
+		"local:172.16.0.0/28,",
+		"local:172.16.0.0/28,172.16.0.0",
+		"local:172.16.0.0/28 ",
+		" local:172.16.0.0/28",
+		"local:172.16.0.0/28;local:10.0.0.0/8",
+		"x;local:172.16.0.0/28",
+	} {
+		if as, class, pool, subpool := idToPool(id); pool != nil {
+			t.Errorf("pool ID %q decoded as %s, %s, %s, %s, want it refused", id, as, class, pool, subpool)
+		}
+		if _, _, err := ParsePoolID(id); err == nil {
+			t.Errorf("ParsePoolID(%q) did not fail", id)
+		}
+	}
+}
+
+func ipnetString(n *net.IPNet) string {
+	if n == nil {
+		return ""
+	}
+	return n.String()
+}
+
+func TestAllocatorError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		is   func(error) bool
+	}{
+		{"exhausted", allocator.ErrExhausted("full"), func(err error) bool { _, ok := err.(types.NoServiceError); return ok }},
+		{"conflict", allocator.ErrConflict("taken"), func(err error) bool { _, ok := err.(types.ForbiddenError); return ok }},
+		{"not found", allocator.ErrNotFound("gone"), func(err error) bool { _, ok := err.(types.NotFoundError); return ok }},
+		{"contention", allocator.ErrContention("busy"), func(err error) bool { _, ok := err.(types.RetryError); return ok }},
+		{"invalid", allocator.ErrInvalidArgument("bad"), func(err error) bool { _, ok := err.(types.BadRequestError); return ok }},
+		{"other", errors.New("disk full"), func(err error) bool { _, ok := err.(types.InternalError); return ok }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := allocatorError("RequestPool", test.err)
+			if !test.is(err) {
+				t.Errorf("allocator error %v became %T", test.err, err)
+			}
+		})
+	}
+}
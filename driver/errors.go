@@ -1,32 +1,27 @@
 package driver
 
-import "fmt"
+import (
+	"fmt"
 
-// ErrUnsupportedIPv6 error is returned when the driver recieves an IPv6 request.
-type ErrUnsupportedIPv6 struct{}
+	"github.com/docker/libnetwork/types"
+	"github.com/nategraf/mini-ipam-driver/allocator"
+)
 
-func (e ErrUnsupportedIPv6) Error() string {
-	return "IPv6 allocation requests are not supported"
-}
-
-// BadRequest denotes the type of this error
-func (e ErrUnsupportedIPv6) BadRequest() {}
+// ErrInvalidSubPool error is returned when a requested sub-pool does not lie within the requested pool.
+type ErrInvalidSubPool string
 
-// ErrUnsupportedPoolReq error is returned when a caller asks for a specific address pool.
-type ErrUnsupportedPoolReq struct{}
-
-func (e ErrUnsupportedPoolReq) Error() string {
-	return "specific pool requests are not supported"
+func (e ErrInvalidSubPool) Error() string {
+	return fmt.Sprintf("sub-pool must be within the requested pool: %s", string(e))
 }
 
 // BadRequest denotes the type of this error
-func (e ErrUnsupportedPoolReq) BadRequest() {}
+func (e ErrInvalidSubPool) BadRequest() {}
 
 // ErrAddrSpaceNotFound error is returned when a caller specifies an unknown address space.
 type ErrAddrSpaceNotFound string
 
 func (e ErrAddrSpaceNotFound) Error() string {
-	return fmt.Sprintf("address space not found: %s", e)
+	return fmt.Sprintf("address space not found: %s", string(e))
 }
 
 // NotFound denotes the type of this error
@@ -46,28 +41,118 @@ func (e ErrNilAllocator) BadRequest() {}
 type ErrParseID string
 
 func (e ErrParseID) Error() string {
-	return fmt.Sprintf("unable to parse pool ID: %s", e)
+	return fmt.Sprintf("unable to parse pool ID: %s", string(e))
 }
 
 // BadRequest denotes the type of this error
 func (e ErrParseID) BadRequest() {}
 
+// ErrParsePool error is returned when a requested pool cannot be parsed.
+type ErrParsePool string
+
+func (e ErrParsePool) Error() string {
+	return fmt.Sprintf("unable to parse pool: %s", string(e))
+}
+
+// BadRequest denotes the type of this error
+func (e ErrParsePool) BadRequest() {}
+
+// ErrInvalidPoolClass error is returned when a requested pool class name is not valid.
+type ErrInvalidPoolClass string
+
+func (e ErrInvalidPoolClass) Error() string {
+	return fmt.Sprintf("invalid pool class: %q", string(e))
+}
+
+// BadRequest denotes the type of this error
+func (e ErrInvalidPoolClass) BadRequest() {}
+
 // ErrParseIP error is returned when an IP address cannot be parsed.
 type ErrParseIP string
 
 func (e ErrParseIP) Error() string {
-	return fmt.Sprintf("unable to parse ip address: %s", e)
+	return fmt.Sprintf("unable to parse ip address: %s", string(e))
 }
 
 // BadRequest denotes the type of this error
 func (e ErrParseIP) BadRequest() {}
 
-// ErrAddrSpaceExhausted error is returned when there are not enough addresses in the pool for the request.
-type ErrAddrSpaceExhausted struct{}
+// ErrAddrSpaceExhausted error is returned when there are not enough addresses in the pool for the request,
+// or allocating them would exceed the configured limits.
+type ErrAddrSpaceExhausted string
 
 func (e ErrAddrSpaceExhausted) Error() string {
-	return "address space does not contain an unallocated suitable pool"
+	return fmt.Sprintf("address space exhausted: %s", string(e))
 }
 
 // NoService denotes the type of this error
 func (e ErrAddrSpaceExhausted) NoService() {}
+
+// ErrMaskLengthLimit error is returned when a requested subnet is larger or smaller than the configured limits allow.
+type ErrMaskLengthLimit string
+
+func (e ErrMaskLengthLimit) Error() string {
+	return fmt.Sprintf("subnet size not allowed: %s", string(e))
+}
+
+// BadRequest denotes the type of this error
+func (e ErrMaskLengthLimit) BadRequest() {}
+
+// ErrConflict error is returned when a request collides with a pool or address which is already allocated or reserved.
+type ErrConflict string
+
+func (e ErrConflict) Error() string {
+	return fmt.Sprintf("conflicts with existing allocation: %s", string(e))
+}
+
+// Forbidden denotes the type of this error
+func (e ErrConflict) Forbidden() {}
+
+// ErrNotFound error is returned when a request refers to a pool, address, or pool class which does not exist.
+type ErrNotFound string
+
+func (e ErrNotFound) Error() string {
+	return fmt.Sprintf("not found: %s", string(e))
+}
+
+// NotFound denotes the type of this error
+func (e ErrNotFound) NotFound() {}
+
+// ErrInvalidRequest error is returned when a request can never succeed as given.
+type ErrInvalidRequest string
+
+func (e ErrInvalidRequest) Error() string {
+	return fmt.Sprintf("invalid request: %s", string(e))
+}
+
+// BadRequest denotes the type of this error
+func (e ErrInvalidRequest) BadRequest() {}
+
+// ErrContention error is returned when the shared state of an address space was changed by others too often to update.
+type ErrContention string
+
+func (e ErrContention) Error() string {
+	return fmt.Sprintf("too many concurrent updates: %s", string(e))
+}
+
+// Retry denotes the type of this error
+func (e ErrContention) Retry() {}
+
+// allocatorError maps an error from an allocator to the error type Docker should see.
+// Errors the allocator does not classify, such as failures to save its state, are internal errors of the given action.
+func allocatorError(action string, err error) error {
+	switch err.(type) {
+	case allocator.ErrExhausted:
+		return ErrAddrSpaceExhausted(err.Error())
+	case allocator.ErrConflict:
+		return ErrConflict(err.Error())
+	case allocator.ErrNotFound:
+		return ErrNotFound(err.Error())
+	case allocator.ErrContention:
+		return ErrContention(err.Error())
+	case allocator.ErrInvalidArgument:
+		return ErrInvalidRequest(err.Error())
+	default:
+		return types.InternalErrorf("%s failed: %s", action, err)
+	}
+}
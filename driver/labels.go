@@ -6,4 +6,22 @@ const (
 
 	// BridgeName label for bridge driver
 	CidrMaskLength = Prefix + ".cidr_mask_length"
+
+	// CidrV6MaskLength label sets the mask length of requested IPv6 subnets
+	CidrV6MaskLength = Prefix + ".cidr_v6_mask_length"
+
+	// PoolClass label selects the pool class a network's subnet is chosen from
+	PoolClass = Prefix + ".pool_class"
+
+	// StickyKey label names the lease a network's subnet is kept under, so it gets the same subnet when recreated
+	StickyKey = Prefix + ".sticky_key"
+
+	// RequestAddressType is the option libnetwork sets to say what an address is requested for
+	RequestAddressType = "RequestAddressType"
+
+	// GatewayAddressType is the RequestAddressType of gateway address requests
+	GatewayAddressType = "com.docker.network.gateway"
+
+	// MacAddress is the option libnetwork sets to the MAC address of an endpoint, when the driver requires it
+	MacAddress = "com.docker.network.endpoint.macaddress"
 )
@@ -0,0 +1,71 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/docker/libnetwork/types"
+	"github.com/nategraf/mini-ipam-driver/allocator"
+)
+
+// Limits bound what may be allocated through the driver, so a runaway client cannot drain the pools.
+// Zero values mean no limit.
+type Limits struct {
+	// MaxPoolsPerClass is the most pools of each address family which may be allocated from each pool class of an address space.
+	MaxPoolsPerClass int
+	// MaxAddresses is the most addresses which may be in the allocated IPv4 pools of an address space.
+	// IPv6 pools are not counted, since a single /64 holds more addresses than any useful limit.
+	MaxAddresses uint64
+	// MinMaskLength and MaxMaskLength bound the mask length of requested IPv4 pools.
+	MinMaskLength int
+	MaxMaskLength int
+	// V6MinMaskLength and V6MaxMaskLength bound the mask length of requested IPv6 pools.
+	V6MinMaskLength int
+	V6MaxMaskLength int
+}
+
+// checkMaskLength checks the mask length of a requested pool against the limits of its address family.
+func (l *Limits) checkMaskLength(masklen int, v6 bool) error {
+	min, max := l.MinMaskLength, l.MaxMaskLength
+	if v6 {
+		min, max = l.V6MinMaskLength, l.V6MaxMaskLength
+	}
+	if min != 0 && masklen < min {
+		return ErrMaskLengthLimit(fmt.Sprintf("/%d is larger than the largest allowed subnet, /%d", masklen, min))
+	}
+	if max != 0 && masklen > max {
+		return ErrMaskLengthLimit(fmt.Sprintf("/%d is smaller than the smallest allowed subnet, /%d", masklen, max))
+	}
+	return nil
+}
+
+// checkUsage checks that allocating another pool would stay within the limits.
+// pool is the requested pool, or nil if the allocator chooses one of the given class and mask length.
+func (l *Limits) checkUsage(a allocator.Allocator, class string, masklen int, v6 bool, pool *net.IPNet) error {
+	if l.MaxPoolsPerClass == 0 && l.MaxAddresses == 0 {
+		return nil
+	}
+
+	usage, err := a.Usage()
+	if err != nil {
+		return types.InternalErrorf("Failed to read allocations: %s", err)
+	}
+
+	if pool != nil {
+		class = usage.ClassOf(pool)
+	}
+	pools, family := usage.Pools, "IPv4"
+	if v6 {
+		pools, family = usage.Pools6, "IPv6"
+	}
+	if l.MaxPoolsPerClass != 0 && class != "" && pools[class] >= l.MaxPoolsPerClass {
+		return ErrAddrSpaceExhausted(fmt.Sprintf("pool class %s already has the most allowed %s pools, %d", class, family, l.MaxPoolsPerClass))
+	}
+	if l.MaxAddresses != 0 && !v6 {
+		size := uint64(1) << uint(8*net.IPv4len-masklen)
+		if usage.Addresses+size > l.MaxAddresses {
+			return ErrAddrSpaceExhausted(fmt.Sprintf("allocating a /%d subnet would exceed the most allowed addresses, %d", masklen, l.MaxAddresses))
+		}
+	}
+	return nil
+}
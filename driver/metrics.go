@@ -0,0 +1,27 @@
+package driver
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mini_ipam_requests_total",
+		Help: "IPAM requests handled by the driver, by method and libnetwork error class.",
+	}, []string{"method", "error"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mini_ipam_request_duration_seconds",
+		Help:    "Time taken to handle IPAM requests, by method and libnetwork error class.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"method", "error"})
+)
+
+// RegisterMetrics registers the request metrics of every Driver with r.
+func RegisterMetrics(r prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{requestsTotal, requestDuration} {
+		if err := r.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+// Package engine is a minimal client for the parts of the Docker Engine API used by the driver.
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nategraf/mini-ipam-driver/unixhttp"
+)
+
+// DefaultSocket is where the Docker daemon listens by default.
+const DefaultSocket = "/var/run/docker.sock"
+
+// Client makes requests to the Docker Engine API.
+type Client struct {
+	// BaseURL is prefixed to every request path.
+	BaseURL string
+	// HTTP is used to make requests, which for a Unix socket must dial the socket.
+	HTTP *http.Client
+}
+
+// NewClient creates a Client which talks to the daemon listening on a Unix socket.
+func NewClient(socket string) *Client {
+	// The host is ignored by the dialer, but must be a valid name
+	return &Client{BaseURL: "http://docker", HTTP: unixhttp.NewClient(socket, 10*time.Second)}
+}
+
+// Network is a Docker network as described by the network inspect endpoint.
+type Network struct {
+	ID         string                     `json:"Id"`
+	Name       string                     `json:"Name"`
+	Scope      string                     `json:"Scope"`
+	Driver     string                     `json:"Driver"`
+	IPAM       IPAM                       `json:"IPAM"`
+	Containers map[string]NetworkEndpoint `json:"Containers"`
+}
+
+// IPAM is the IPAM configuration of a network.
+type IPAM struct {
+	Driver  string            `json:"Driver"`
+	Options map[string]string `json:"Options"`
+	Config  []IPAMConfig      `json:"Config"`
+}
+
+// IPAMConfig describes one subnet of a network.
+type IPAMConfig struct {
+	Subnet  string `json:"Subnet"`
+	IPRange string `json:"IPRange"`
+	Gateway string `json:"Gateway"`
+	// AuxiliaryAddresses are addresses Docker holds for other hosts on the network, keyed by host name.
+	AuxiliaryAddresses map[string]string `json:"AuxiliaryAddresses"`
+}
+
+// NetworkEndpoint is a container attached to a network.
+// The addresses are given in CIDR notation, such as 172.16.0.2/28.
+type NetworkEndpoint struct {
+	Name        string `json:"Name"`
+	MacAddress  string `json:"MacAddress"`
+	IPv4Address string `json:"IPv4Address"`
+	IPv6Address string `json:"IPv6Address"`
+}
+
+// Networks gives every network using the named IPAM driver, including their attached containers.
+func (c *Client) Networks(ipamDriver string) ([]*Network, error) {
+	// The list endpoint does not include containers, so each network is inspected in turn
+	var list []*Network
+	if err := c.get("/networks", &list); err != nil {
+		return nil, err
+	}
+
+	var res []*Network
+	for _, n := range list {
+		if n.IPAM.Driver != ipamDriver {
+			continue
+		}
+		network := &Network{}
+		if err := c.get("/networks/"+url.PathEscape(n.ID), network); err != nil {
+			return nil, err
+		}
+		res = append(res, network)
+	}
+	return res, nil
+}
+
+// get makes a GET request and decodes the JSON response into v.
+func (c *Client) get(path string, v interface{}) error {
+	resp, err := c.HTTP.Get(c.BaseURL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Docker returned %s for %s: %s", resp.Status, path, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("Failed to parse Docker response for %s: %s", path, err)
+	}
+	return nil
+}
@@ -1,35 +1,152 @@
 package main
 
 import (
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
 	"github.com/docker/go-plugins-helpers/ipam"
+	"github.com/nategraf/mini-ipam-driver/admin"
 	"github.com/nategraf/mini-ipam-driver/allocator"
 	"github.com/nategraf/mini-ipam-driver/driver"
 	"github.com/sirupsen/logrus"
 )
 
-const socketAddress = "/run/docker/plugins/mini.sock"
+const defaultSocketAddress = "/run/docker/plugins/mini.sock"
 
 func main() {
-	a, err := allocator.LoadLocalAllocator()
+	// Serving is the default, so flags alone work as they did before there were subcommands
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	os.Exit(runCommand(cmd, args))
+}
+
+// serve runs the plugin, serving requests from Docker until the process exits.
+func serve(conf *Config) {
+	store, err := conf.OpenStore()
+	if err != nil {
+		logrus.Fatalf("Failed to open allocator state store: %s", err)
+	}
+
+	a, err := allocator.LoadLocalAllocator(store)
 	if err == nil {
 		logrus.Infof("Successfully loaded allocator state")
-		dump := a.Dump()
-		logrus.Infof("Free pools: %s", dump["free"])
-		logrus.Infof("Allocated: %s", dump["allocated"])
-	} else {
-		logrus.Infof("Failed to load allocator state from file: %s", err)
-
-		a = allocator.NewLocalAllocator()
-		for _, pool := range driver.DefaultPools {
-			err := a.AddPool(pool)
-			if err != nil {
-				logrus.Fatalf("Failed to add pool: %s", pool.String())
-			}
-			logrus.Infof("Added pool to allocator: %s", pool.String())
+	} else if os.IsNotExist(err) {
+		logrus.Infof("No saved allocator state found in %s store", conf.Store)
+		a, err = allocator.NewLocalAllocator(store), nil
+	}
+	if err != nil {
+		logrus.Fatalf("Failed to load allocator state: %s", err)
+	}
+
+	gateway, _ := allocator.ParseGatewayPosition(conf.Gateway)
+	a.SetGatewayPosition(gateway)
+	policy, _ := allocator.ParseSelectionPolicy(conf.Selection)
+	a.SetSelectionPolicy(policy)
+	if conf.AvoidHost {
+		a.SetAvoid(allocator.HostNetworks)
+	}
+	reserved, _ := conf.ReservedOffsets()
+	a.SetReservedOffsets(reserved)
+
+	excluded, _ := conf.ExcludedPools()
+	conflicts, err := a.SetExcluded(excluded)
+	if err != nil {
+		logrus.Fatalf("Failed to exclude subnets: %s", err)
+	}
+	for _, pool := range conflicts {
+		logrus.Warnf("Allocated pool overlaps an excluded subnet, which will be retired when the pool is released: %s", pool.String())
+	}
+
+	classes, _ := conf.ClassPools()
+	diffs, err := a.ReconcileClasses(classes)
+	if err != nil {
+		logrus.Fatalf("Failed to reconcile pools: %s", err)
+	}
+	for _, class := range sortedClasses(diffs) {
+		for _, pool := range diffs[class].Added {
+			logrus.Infof("Added pool to allocator class %s: %s", class, pool.String())
 		}
+		for _, pool := range diffs[class].Retired {
+			logrus.Infof("Retired free pool from allocator class %s: %s", class, pool.String())
+		}
+		for _, pool := range diffs[class].Orphaned {
+			logrus.Warnf("Allocated pool is outside of the configured pools and will be retired when released: %s", pool.String())
+		}
+	}
+
+	reconcileDocker(conf, a)
+
+	dump := a.Dump()
+	logrus.Infof("Free pools: %s", dump["free"])
+	logrus.Infof("Allocated pools: %s", dump["allocated"])
+	logrus.Infof("Allocated addresses: %s", dump["addresses"])
+	stats := a.Stats()
+	for _, class := range a.Classes() {
+		logrus.Infof("Free IPv4 addresses in class %s unusable for a /%d subnet: %.1f%%", class, conf.MaskLength, 100*stats.Fragmentation(class, conf.MaskLength, false))
+		logrus.Infof("Free IPv6 addresses in class %s unusable for a /%d subnet: %.1f%%", class, conf.V6MaskLength, 100*stats.Fragmentation(class, conf.V6MaskLength, true))
+	}
+
+	d := &driver.Driver{Local: a, Global: nil, MaskLength: conf.MaskLength, V6MaskLength: conf.V6MaskLength, Limits: conf.Limits(), StickyAddresses: conf.StickyAddrs}
+	if conf.GlobalStore != "" {
+		d.Global = globalAllocator(conf, gateway, policy)
+	}
+	if conf.Admin != "" {
+		go serveAdmin(conf.Admin, d)
+	}
+	if conf.Metrics != "" {
+		go serveMetrics(conf, a)
 	}
 
-	d := &driver.Driver{Local: a, Global: nil}
 	h := ipam.NewHandler(d)
-	h.ServeUnix(socketAddress, 0)
+	h.ServeUnix(conf.Socket, 0)
+}
+
+// sortedClasses gives the class names of reconcile diffs in sorted order.
+func sortedClasses(diffs map[string]*allocator.PoolDiff) []string {
+	var names []string
+	for name := range diffs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// globalAllocator connects to the global store and reconciles it with the configured global pools.
+func globalAllocator(conf *Config, gateway allocator.GatewayPosition, policy allocator.SelectionPolicy) *allocator.GlobalAllocator {
+	store, key, _ := allocator.ParseKVStore(conf.GlobalStore)
+	g := allocator.NewGlobalAllocator(store, key)
+	g.SetGatewayPosition(gateway)
+	g.SetSelectionPolicy(policy)
+
+	pools, _ := conf.GlobalBasePools()
+	diff, err := g.ReconcilePools(pools)
+	if err != nil {
+		logrus.Fatalf("Failed to reconcile global pools: %s", err)
+	}
+	for _, pool := range diff.Added {
+		logrus.Infof("Added pool to global allocator: %s", pool.String())
+	}
+	for _, pool := range diff.Retired {
+		logrus.Infof("Retired free pool from global allocator: %s", pool.String())
+	}
+	for _, pool := range diff.Orphaned {
+		logrus.Warnf("Allocated global pool is outside of the configured pools and will be retired when released: %s", pool.String())
+	}
+	return g
+}
+
+// serveAdmin serves the admin API for the driver's allocators.
+func serveAdmin(addr string, d *driver.Driver) {
+	l, err := admin.Listen(addr)
+	if err != nil {
+		logrus.Fatalf("Failed to listen for admin API: %s", err)
+	}
+	logrus.Infof("Serving admin API on %s", addr)
+	if err := http.Serve(l, admin.NewServer(d.Local, d.Global)); err != nil {
+		logrus.Fatalf("Admin API failed: %s", err)
+	}
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/nategraf/mini-ipam-driver/allocator"
+	"github.com/nategraf/mini-ipam-driver/driver"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	freePoolsDesc = prometheus.NewDesc("mini_ipam_free_pools",
+		"Free pools in the local allocator, by pool class, address family, and mask length.", []string{"class", "family", "mask_length"}, nil)
+	freeAddressesDesc = prometheus.NewDesc("mini_ipam_free_addresses",
+		"Addresses in the free pools of the local allocator, by pool class, address family, and mask length.", []string{"class", "family", "mask_length"}, nil)
+	fragmentationDesc = prometheus.NewDesc("mini_ipam_fragmentation",
+		"Fraction of the free addresses in pools smaller than the default subnet size, by pool class and address family.", []string{"class", "family"}, nil)
+	allocatedPoolsDesc = prometheus.NewDesc("mini_ipam_allocated_pools",
+		"Pools allocated from the local allocator.", nil, nil)
+	allocatedAddressesDesc = prometheus.NewDesc("mini_ipam_allocated_addresses",
+		"Addresses allocated in the pools of the local allocator, including gateways.", nil, nil)
+	saveFailuresDesc = prometheus.NewDesc("mini_ipam_save_failures_total",
+		"Allocator state snapshots which could not be saved.", nil, nil)
+	journalFailuresDesc = prometheus.NewDesc("mini_ipam_journal_failures_total",
+		"Allocator changes refused because they could not be recorded in the journal.", nil, nil)
+)
+
+// allocatorCollector collects the metrics describing the utilization of a local allocator, read when scraped.
+// Fragmentation is measured against the configured default mask lengths.
+type allocatorCollector struct {
+	a                  *allocator.LocalAllocator
+	masklen, v6masklen int
+}
+
+func (c *allocatorCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{freePoolsDesc, freeAddressesDesc, fragmentationDesc,
+		allocatedPoolsDesc, allocatedAddressesDesc, saveFailuresDesc, journalFailuresDesc} {
+		ch <- d
+	}
+}
+
+func (c *allocatorCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.a.Stats()
+	for _, free := range stats.Free {
+		family := "ipv4"
+		if free.V6 {
+			family = "ipv6"
+		}
+		masklen := strconv.Itoa(free.MaskLength)
+		ch <- prometheus.MustNewConstMetric(freePoolsDesc, prometheus.GaugeValue, float64(free.Pools), free.Class, family, masklen)
+		ch <- prometheus.MustNewConstMetric(freeAddressesDesc, prometheus.GaugeValue, free.Addresses, free.Class, family, masklen)
+	}
+	for _, class := range c.a.Classes() {
+		ch <- prometheus.MustNewConstMetric(fragmentationDesc, prometheus.GaugeValue, stats.Fragmentation(class, c.masklen, false), class, "ipv4")
+		ch <- prometheus.MustNewConstMetric(fragmentationDesc, prometheus.GaugeValue, stats.Fragmentation(class, c.v6masklen, true), class, "ipv6")
+	}
+	ch <- prometheus.MustNewConstMetric(allocatedPoolsDesc, prometheus.GaugeValue, float64(stats.AllocatedPools))
+	ch <- prometheus.MustNewConstMetric(allocatedAddressesDesc, prometheus.GaugeValue, float64(stats.AllocatedAddresses))
+	ch <- prometheus.MustNewConstMetric(saveFailuresDesc, prometheus.CounterValue, float64(stats.SaveFailures))
+	ch <- prometheus.MustNewConstMetric(journalFailuresDesc, prometheus.CounterValue, float64(stats.JournalFailures))
+}
+
+// serveMetrics serves Prometheus metrics for the driver and its local allocator at /metrics.
+func serveMetrics(conf *Config, a *allocator.LocalAllocator) {
+	r := prometheus.NewRegistry()
+	if err := driver.RegisterMetrics(r); err != nil {
+		logrus.Fatalf("Failed to register driver metrics: %s", err)
+	}
+	r.MustRegister(&allocatorCollector{a: a, masklen: conf.MaskLength, v6masklen: conf.V6MaskLength})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(r, promhttp.HandlerOpts{}))
+
+	logrus.Infof("Serving metrics on %s", conf.Metrics)
+	if err := http.ListenAndServe(conf.Metrics, mux); err != nil {
+		logrus.Fatalf("Metrics server failed: %s", err)
+	}
+}
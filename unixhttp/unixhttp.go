@@ -0,0 +1,21 @@
+// Package unixhttp makes HTTP requests to servers listening on Unix sockets.
+package unixhttp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// NewClient creates an http.Client which sends every request to the server listening on the Unix socket at path,
+// whatever the host of the request URL.
+func NewClient(path string, timeout time.Duration) *http.Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}
+}